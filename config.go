@@ -2,11 +2,13 @@ package main
 
 import (
 	"bufio"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"reflect"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -14,40 +16,64 @@ import (
 	"gopkg.in/yaml.v2"
 )
 
+// defaultGitCommandTimeout is the timeout in seconds for git clone, fetch and archive commands if no timeouts setting is configured
+const defaultGitCommandTimeout = 300
+
+// defaultCommandTimeout is the timeout in seconds for local commands and the postrun command if no timeout setting is configured
+const defaultCommandTimeout = 300
+
+// defaultMaintenanceTimeout is the timeout in seconds for git gc, commit-graph and fsck of a single git mirror if no timeouts.maintenance setting is configured
+const defaultMaintenanceTimeout = 3600
+
 var (
-	reModuledir = regexp.MustCompile(`^\s*(?:moduledir)\s+['\"]?([^'\"]+)['\"]?`)
+	reModuledir           = regexp.MustCompile(`^\s*(?:moduledir)\s+['\"]?([^'\"]+)['\"]?`)
+	reConfigInterpolation = regexp.MustCompile(`\$?\$\{([^}]+)\}`)
 )
 
-// readConfigfile creates the ConfigSettings struct from the g10k config file
+// readConfigfile creates the ConfigSettings struct from the g10k config file, its included files and the config files inside the -configdir directory
 func readConfigfile(configFile string) ConfigSettings {
-	Debugf("Trying to read g10k config file: " + configFile)
-	data, err := ioutil.ReadFile(configFile)
-	if err != nil {
-		Fatalf("readConfigfile(): There was an error parsing the config file " + configFile + ": " + err.Error())
+	configOrigins = make(map[string]string)
+	tree := make(map[interface{}]interface{})
+	visited := make(map[string]bool)
+	if len(configFile) > 0 {
+		mergeConfigfile(tree, configFile, visited)
 	}
-
-	rubySymbolsRemoved := ""
-	for _, line := range strings.Split(string(data), "\n") {
-		reWhitespaceColon := regexp.MustCompile(`^(\s*):`)
-		m := reWhitespaceColon.FindStringSubmatch(line)
-		if len(m) > 0 {
-			rubySymbolsRemoved += reWhitespaceColon.ReplaceAllString(line, m[1]) + "\n"
-		} else {
-			rubySymbolsRemoved += line + "\n"
+	if len(configDir) > 0 {
+		for _, file := range configDirFiles(configDir) {
+			mergeConfigfile(tree, file, visited)
 		}
 	}
+
+	interpolateConfigTree(tree, "")
+
+	mergedConfig, err := yaml.Marshal(tree)
+	if err != nil {
+		Fatalf("readConfigfile(): Error while encoding the merged config Error: " + err.Error())
+	}
 	var config ConfigSettings
-	err = yaml.Unmarshal([]byte(rubySymbolsRemoved), &config)
+	err = yaml.Unmarshal(mergedConfig, &config)
 	if err != nil {
 		Fatalf("YAML unmarshal error: " + err.Error())
 	}
+	config.Git.Credentials = loadGitCredentials(config.Git.Credentials)
+	checkGitRepositories(config.Git.Repositories)
+	checkHostLimits(config.Git, config.Forge)
+	if len(config.Git.GPGHome) > 0 && !isDir(config.Git.GPGHome) {
+		Fatalf("Error: could not find directory " + config.Git.GPGHome + " of config setting git.gpg_home in config file " + configOrigins["git.gpg_home"])
+	}
+	if len(config.Git.AllowedSignersFile) > 0 && !fileExists(config.Git.AllowedSignersFile) {
+		Fatalf("Error: could not find file " + config.Git.AllowedSignersFile + " of config setting git.allowed_signers_file in config file " + configOrigins["git.allowed_signers_file"])
+	}
+	if validate {
+		printEffectiveConfig(tree, "", "")
+	}
 
 	if len(os.Getenv("g10k_cachedir")) > 0 {
 		cachedir := os.Getenv("g10k_cachedir")
 		Debugf("Found environment variable g10k_cachedir set to: " + cachedir)
 		config.CacheDir = checkDirAndCreate(cachedir, "cachedir environment variable g10k_cachedir")
 	} else {
-		config.CacheDir = checkDirAndCreate(config.CacheDir, "cachedir from g10k config "+configFile)
+		config.CacheDir = checkDirAndCreate(config.CacheDir, "cachedir from g10k config "+configOrigins["cachedir"])
 	}
 
 	config.CacheDir = checkDirAndCreate(config.CacheDir, "cachedir")
@@ -66,6 +92,8 @@ func readConfigfile(configFile string) ConfigSettings {
 		config.Timeout = 5
 	}
 
+	setLinkMode()
+
 	if usecacheFallback {
 		config.UseCacheFallback = true
 	}
@@ -105,11 +133,19 @@ func readConfigfile(configFile string) ConfigSettings {
 	if len(config.ForgeCacheTTLString) != 0 {
 		ttl, err := time.ParseDuration(config.ForgeCacheTTLString)
 		if err != nil {
-			Fatalf("Error: Can not convert value " + config.ForgeCacheTTLString + " of config setting forge_cache_ttl to a golang Duration. Valid time units are 300ms, 1.5h or 2h45m. In " + configFile)
+			Fatalf("Error: Can not convert value " + config.ForgeCacheTTLString + " of config setting forge_cache_ttl to a golang Duration. Valid time units are 300ms, 1.5h or 2h45m. In " + configOrigins["forge_cache_ttl"])
 		}
 		config.ForgeCacheTTL = ttl
 	}
 
+	if len(config.Git.MaintenanceIntervalString) != 0 {
+		interval, err := time.ParseDuration(config.Git.MaintenanceIntervalString)
+		if err != nil {
+			Fatalf("Error: Can not convert value " + config.Git.MaintenanceIntervalString + " of config setting git.maintenance_interval to a golang Duration. Valid time units are 300ms, 1.5h or 2h45m. In " + configOrigins["git.maintenance_interval"])
+		}
+		config.Git.MaintenanceInterval = interval
+	}
+
 	// check for non-empty config.Deploy which takes precedence over the non-deploy scoped settings
 	// See https://github.com/puppetlabs/r10k/blob/master/doc/dynamic-environments/configuration.mkd#deploy
 	emptyDeploy := DeploySettings{}
@@ -137,6 +173,18 @@ func readConfigfile(configFile string) ConfigSettings {
 		if len(sa.AutoCorrectEnvironmentNames) == 0 {
 			sa.AutoCorrectEnvironmentNames = "correct_and_warn"
 		}
+
+		if len(sa.MirrorMode) > 0 && !isValidMirrorMode(sa.MirrorMode) {
+			Fatalf("Error: Invalid value " + sa.MirrorMode + " of config setting mirror_mode for source " + source + ", valid values are full, partial and shallow. In " + configOrigins["sources."+source+".mirror_mode"])
+		}
+
+		// per source cache directory, which overrides the global cachedir for this source
+		if len(sa.CacheDir) > 0 {
+			sa.CacheDir = checkDirAndCreate(sa.CacheDir, "cachedir of source "+source)
+			sa.ForgeCacheDir = checkDirAndCreate(filepath.Join(sa.CacheDir, "forge"), "cachedir/forge of source "+source)
+			sa.ModulesCacheDir = checkDirAndCreate(filepath.Join(sa.CacheDir, "modules"), "cachedir/modules of source "+source)
+			sa.EnvCacheDir = checkDirAndCreate(filepath.Join(sa.CacheDir, "environments"), "cachedir/environments of source "+source)
+		}
 		config.Sources[source] = sa
 	}
 
@@ -148,6 +196,504 @@ func readConfigfile(configFile string) ConfigSettings {
 	return config
 }
 
+// loadGitCredentials checks the git.credentials config settings, reads the token files and registers all tokens as secrets
+func loadGitCredentials(credentials []GitCredential) []GitCredential {
+	for i, c := range credentials {
+		if len(c.Host) == 0 {
+			Fatalf("Error: config setting host is missing for git credential number " + strconv.Itoa(i+1) + " in config file " + configOrigins["git.credentials"])
+		}
+		if _, err := filepath.Match(c.Host, ""); err != nil {
+			Fatalf("Error: invalid host pattern " + c.Host + " for git credential in config file " + configOrigins["git.credentials"] + " Error: " + err.Error())
+		}
+		methods := 0
+		for _, m := range []string{c.Token, c.TokenFile, c.Helper} {
+			if len(m) > 0 {
+				methods++
+			}
+		}
+		if methods != 1 {
+			Fatalf("Error: git credential for host " + c.Host + " must set exactly one of token, token_file or helper in config file " + configOrigins["git.credentials"])
+		}
+		if len(c.TokenFile) > 0 {
+			content, err := ioutil.ReadFile(c.TokenFile)
+			if err != nil {
+				Fatalf("Error: could not read token_file " + c.TokenFile + " for git credential of host " + c.Host + " Error: " + err.Error())
+			}
+			c.Token = strings.TrimSpace(string(content))
+		}
+		if len(c.Username) == 0 {
+			c.Username = "oauth2"
+		}
+		addSecret(c.Token)
+		credentials[i] = c
+	}
+	return credentials
+}
+
+// checkGitRepositories checks that all git.repositories entries have a valid remote pattern and that their SSH key and known_hosts files exist, the regular expressions of the remote patterns get compiled once
+func checkGitRepositories(repositories []GitRepository) {
+	for i, repo := range repositories {
+		if len(repo.Remote) == 0 {
+			Fatalf("Error: config setting remote is missing for git repository number " + strconv.Itoa(i+1) + " in config file " + configOrigins["git.repositories"])
+			continue
+		}
+		if len(repo.Remote) > 1 && strings.HasPrefix(repo.Remote, "/") && strings.HasSuffix(repo.Remote, "/") {
+			re, err := regexp.Compile(repo.Remote[1 : len(repo.Remote)-1])
+			if err != nil {
+				Fatalf("Error: invalid regular expression " + repo.Remote + " for git repository in config file " + configOrigins["git.repositories"] + " Error: " + err.Error())
+				continue
+			}
+			repositories[i].remoteRegexp = re
+		}
+		for _, file := range []string{repo.PrivateKey, repo.KnownHostsFile} {
+			if len(file) == 0 {
+				continue
+			}
+			if _, err := os.Stat(file); err != nil {
+				Fatalf("Error: could not find file " + file + " for git repository " + repo.Remote + " in config file " + configOrigins["git.repositories"] + " Error: " + err.Error())
+			}
+		}
+	}
+}
+
+// parseConfigfile reads a single g10k config file and returns its content as YAML tree
+func parseConfigfile(configFile string) map[interface{}]interface{} {
+	Debugf("Trying to read g10k config file: " + configFile)
+	data, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		Fatalf("readConfigfile(): There was an error parsing the config file " + configFile + ": " + err.Error())
+	}
+
+	rubySymbolsRemoved := ""
+	for _, line := range strings.Split(string(data), "\n") {
+		reWhitespaceColon := regexp.MustCompile(`^(\s*):`)
+		m := reWhitespaceColon.FindStringSubmatch(line)
+		if len(m) > 0 {
+			rubySymbolsRemoved += reWhitespaceColon.ReplaceAllString(line, m[1]) + "\n"
+		} else {
+			rubySymbolsRemoved += line + "\n"
+		}
+	}
+	tree := make(map[interface{}]interface{})
+	err = yaml.Unmarshal([]byte(rubySymbolsRemoved), &tree)
+	if err != nil {
+		Fatalf("YAML unmarshal error in config file " + configFile + ": " + err.Error())
+	}
+	return tree
+}
+
+// mergeConfigfile deep-merges the given config file and all files of its include setting into tree
+func mergeConfigfile(tree map[interface{}]interface{}, configFile string, visited map[string]bool) {
+	absPath, err := filepath.Abs(configFile)
+	if err != nil {
+		Fatalf("mergeConfigfile(): Error while resolving absolute file path for " + configFile + " Error: " + err.Error())
+	}
+	if visited[absPath] {
+		Debugf("Skipping config file " + configFile + ", because it was already included")
+		return
+	}
+	visited[absPath] = true
+
+	fileTree := parseConfigfile(configFile)
+	includes := []string{}
+	switch include := fileTree["include"].(type) {
+	case nil:
+	case string:
+		includes = append(includes, include)
+	case []interface{}:
+		for _, i := range include {
+			includes = append(includes, fmt.Sprint(i))
+		}
+	default:
+		Fatalf("Error: config setting include must be a file name or a list of file names or globs in config file " + configFile)
+	}
+	delete(fileTree, "include")
+
+	mergeConfigTree(tree, fileTree, "", configFile)
+
+	for _, include := range includes {
+		if !filepath.IsAbs(include) {
+			include = filepath.Join(filepath.Dir(configFile), include)
+		}
+		matches, err := filepath.Glob(include)
+		if err != nil {
+			Fatalf("Error: invalid include pattern " + include + " in config file " + configFile + " Error: " + err.Error())
+		}
+		if len(matches) == 0 && !strings.ContainsAny(include, "*?[") {
+			Fatalf("Error: could not find included config file " + include + " from config file " + configFile)
+		}
+		sort.Strings(matches)
+		for _, match := range matches {
+			mergeConfigfile(tree, match, visited)
+		}
+	}
+}
+
+// mergeConfigTree deep-merges src into dst, later values override earlier ones except for source names, which must be unique over all config files
+func mergeConfigTree(dst map[interface{}]interface{}, src map[interface{}]interface{}, path string, configFile string) {
+	for k, v := range src {
+		keyPath := fmt.Sprint(k)
+		if len(path) > 0 {
+			keyPath = path + "." + keyPath
+		}
+		if path == "sources" {
+			if _, ok := dst[k]; ok {
+				Fatalf("Error: source " + fmt.Sprint(k) + " is defined in config file " + configOrigins[keyPath] + " and in config file " + configFile)
+			}
+		}
+		srcMap, srcIsMap := v.(map[interface{}]interface{})
+		dstMap, dstIsMap := dst[k].(map[interface{}]interface{})
+		if srcIsMap {
+			if !dstIsMap {
+				dstMap = make(map[interface{}]interface{})
+				dst[k] = dstMap
+			}
+			if _, ok := configOrigins[keyPath]; !ok || !dstIsMap {
+				configOrigins[keyPath] = configFile
+			}
+			mergeConfigTree(dstMap, srcMap, keyPath, configFile)
+			continue
+		}
+		dst[k] = v
+		configOrigins[keyPath] = configFile
+	}
+}
+
+// interpolateConfigTree replaces ${ENV_VAR}, ${ENV_VAR:-default} and ${file:/path} in all string values of the config tree, $${ is kept as a literal ${
+func interpolateConfigTree(tree map[interface{}]interface{}, path string) {
+	for k, v := range tree {
+		keyPath := fmt.Sprint(k)
+		if len(path) > 0 {
+			keyPath = path + "." + keyPath
+		}
+		tree[k] = interpolateConfigValue(v, keyPath)
+	}
+}
+
+// interpolateConfigValue interpolates the given config value and all values nested inside of it
+func interpolateConfigValue(v interface{}, keyPath string) interface{} {
+	switch value := v.(type) {
+	case map[interface{}]interface{}:
+		interpolateConfigTree(value, keyPath)
+	case []interface{}:
+		for i, item := range value {
+			value[i] = interpolateConfigValue(item, keyPath)
+		}
+	case string:
+		interpolated := interpolateConfigString(value, keyPath)
+		if interpolated != value {
+			return interpolatedConfigScalar(interpolated)
+		}
+	}
+	return v
+}
+
+// interpolatedConfigScalar returns interpolated numbers and booleans with their YAML type, so that they can be used for settings like timeout
+func interpolatedConfigScalar(s string) interface{} {
+	var scalar interface{}
+	if err := yaml.Unmarshal([]byte(s), &scalar); err == nil {
+		switch scalar.(type) {
+		case int, int64, uint64, float64, bool:
+			return scalar
+		}
+	}
+	return s
+}
+
+// isCredentialConfigKey checks if the given config key contains a token, password or private key
+func isCredentialConfigKey(keyPath string) bool {
+	key := strings.ToLower(keyPath[strings.LastIndex(keyPath, ".")+1:])
+	for _, credential := range []string{"token", "password", "secret", "private_key"} {
+		if strings.Contains(key, credential) {
+			return true
+		}
+	}
+	return false
+}
+
+// interpolateConfigString replaces all placeholders in the given string, file contents and environment variables used in credential settings are registered as secrets
+func interpolateConfigString(s string, keyPath string) string {
+	return reConfigInterpolation.ReplaceAllStringFunc(s, func(placeholder string) string {
+		if strings.HasPrefix(placeholder, "$$") {
+			// escaped placeholder
+			return placeholder[1:]
+		}
+		expression := reConfigInterpolation.FindStringSubmatch(placeholder)[1]
+		if strings.HasPrefix(expression, "file:") {
+			file := strings.TrimPrefix(expression, "file:")
+			content, err := ioutil.ReadFile(file)
+			if err != nil {
+				Fatalf("Error: could not read file " + file + " used in config setting " + keyPath + " in config file " + configOrigins[keyPath] + " Error: " + err.Error())
+				return ""
+			}
+			secret := strings.TrimRight(string(content), "\r\n")
+			addSecret(secret)
+			return secret
+		}
+		name := expression
+		defaultValue := ""
+		hasDefault := false
+		if i := strings.Index(expression, ":-"); i >= 0 {
+			name = expression[:i]
+			defaultValue = expression[i+2:]
+			hasDefault = true
+		}
+		if value, ok := os.LookupEnv(name); ok && len(value) > 0 {
+			if isCredentialConfigKey(keyPath) {
+				addSecret(value)
+			}
+			return value
+		}
+		if !hasDefault {
+			Fatalf("Error: environment variable " + name + " used in config setting " + keyPath + " in config file " + configOrigins[keyPath] + " is not set")
+		}
+		return defaultValue
+	})
+}
+
+// configDirFiles returns all YAML files inside the -configdir directory in lexical order
+func configDirFiles(dir string) []string {
+	if !isDir(dir) {
+		Fatalf("Error: could not find config directory " + dir)
+	}
+	files := []string{}
+	for _, pattern := range []string{"*.yaml", "*.yml"} {
+		matches, _ := filepath.Glob(filepath.Join(dir, pattern))
+		files = append(files, matches...)
+	}
+	sort.Strings(files)
+	return files
+}
+
+// printEffectiveConfig prints the merged config tree and the config file each key came from
+func printEffectiveConfig(tree map[interface{}]interface{}, path string, indent string) {
+	keys := []string{}
+	values := make(map[string]interface{})
+	for k, v := range tree {
+		keys = append(keys, fmt.Sprint(k))
+		values[fmt.Sprint(k)] = v
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		keyPath := k
+		if len(path) > 0 {
+			keyPath = path + "." + k
+		}
+		if m, ok := values[k].(map[interface{}]interface{}); ok {
+			fmt.Println(indent + k + ":  # " + configOrigins[keyPath])
+			printEffectiveConfig(m, keyPath, indent+"  ")
+			continue
+		}
+		value, _ := yaml.Marshal(map[string]interface{}{k: values[k]})
+		lines := strings.Split(strings.TrimSuffix(string(value), "\n"), "\n")
+		fmt.Println(redactSecrets(indent + lines[0] + "  # " + configOrigins[keyPath]))
+		for _, line := range lines[1:] {
+			fmt.Println(redactSecrets(indent + line))
+		}
+	}
+}
+
+// resolveSourceSettings returns the given source with the global config values filled in for all settings that the source does not override
+func resolveSourceSettings(sa Source) Source {
+	if sa.Timeout <= 0 {
+		sa.Timeout = config.Timeout
+	}
+	if sa.Maxworker <= 0 {
+		sa.Maxworker = config.Maxworker
+	}
+	if sa.MaxExtractworker <= 0 {
+		sa.MaxExtractworker = config.MaxExtractworker
+	}
+	if len(sa.ForgeBaseURL) == 0 {
+		sa.ForgeBaseURL = config.ForgeBaseURL
+	}
+	if len(sa.CacheDir) == 0 {
+		sa.CacheDir = config.CacheDir
+		sa.ForgeCacheDir = config.ForgeCacheDir
+		sa.ModulesCacheDir = config.ModulesCacheDir
+		sa.EnvCacheDir = config.EnvCacheDir
+	}
+	return sa
+}
+
+// isEnvCacheDir checks if the given directory is located in the global or in a source specific environments cache directory
+func isEnvCacheDir(dir string) bool {
+	if len(config.EnvCacheDir) > 0 && strings.HasPrefix(dir, config.EnvCacheDir) {
+		return true
+	}
+	for _, sa := range config.Sources {
+		if len(sa.EnvCacheDir) > 0 && strings.HasPrefix(dir, sa.EnvCacheDir) {
+			return true
+		}
+	}
+	return false
+}
+
+// isModulesCacheDir checks if the given directory is located in the global or in a source specific modules cache directory
+func isModulesCacheDir(dir string) bool {
+	if len(config.ModulesCacheDir) > 0 && strings.HasPrefix(dir, config.ModulesCacheDir) {
+		return true
+	}
+	for _, sa := range config.Sources {
+		if len(sa.ModulesCacheDir) > 0 && strings.HasPrefix(dir, sa.ModulesCacheDir) {
+			return true
+		}
+	}
+	return false
+}
+
+// isForgeCacheDir checks if the given directory is the global or a source specific Forge cache directory
+func isForgeCacheDir(dir string) bool {
+	if strings.HasPrefix(filepath.Base(dir), tempPathPrefix) {
+		// Forge modules get extracted into a temporary directory inside the Forge cache dir first
+		dir = filepath.Dir(dir)
+	}
+	if filepath.Base(filepath.Dir(dir)) == "forges" {
+		// modules of another Forge than forge_base_url are cached in a subdirectory per Forge
+		dir = filepath.Dir(filepath.Dir(dir))
+	}
+	if dir == config.ForgeCacheDir {
+		return true
+	}
+	for _, sa := range config.Sources {
+		if len(sa.ForgeCacheDir) > 0 && dir == sa.ForgeCacheDir {
+			return true
+		}
+	}
+	return false
+}
+
+// forgeCacheDir returns the Forge cache directory of the source the given Forge module belongs to, modules of another Forge
+// than the configured forge_base_url get cached in a subdirectory per Forge, because the archives are cached by name and version
+func forgeCacheDir(fm ForgeModule) string {
+	cacheDir := config.ForgeCacheDir
+	if len(fm.cacheDir) > 0 {
+		cacheDir = fm.cacheDir
+	}
+	baseURL := normalizeForgeBaseURL(fm.baseURL)
+	if len(baseURL) == 0 || len(config.ForgeBaseURL) == 0 || baseURL == normalizeForgeBaseURL(config.ForgeBaseURL) {
+		return cacheDir
+	}
+	// create save directory name from the Forge URL without the scheme
+	if i := strings.Index(baseURL, "://"); i >= 0 {
+		baseURL = baseURL[i+3:]
+	}
+	return filepath.Join(cacheDir, "forges", strings.Replace(strings.Replace(baseURL, "/", "_", -1), ":", "-", -1))
+}
+
+// normalizeForgeBaseURL returns the given Forge base URL without a trailing slash and with the current name of the Puppet Forge
+func normalizeForgeBaseURL(baseURL string) string {
+	// forgeapi.puppetlabs.com is the old name of the Puppet Forge
+	return strings.Replace(strings.TrimSuffix(baseURL, "/"), "://forgeapi.puppetlabs.com", "://forgeapi.puppet.com", 1)
+}
+
+// gitModuleCacheDir returns the directory of the mirrored git repository of the given git module
+func gitModuleCacheDir(gm GitModule) string {
+	modulesCacheDir := config.ModulesCacheDir
+	if len(gm.cacheDir) > 0 {
+		modulesCacheDir = gm.cacheDir
+	}
+	// create save directory name from Git repo name without any credentials
+	repoDir := strings.Replace(strings.Replace(normalizeGitURL(gm.git), "/", "_", -1), ":", "-", -1)
+	return filepath.Join(modulesCacheDir, repoDir)
+}
+
+// setLinkMode applies the -linkmode parameter and the default hardlink to the link_mode setting
+func setLinkMode() {
+	if len(linkModeParam) > 0 {
+		config.LinkMode = linkModeParam
+	}
+	if len(config.LinkMode) == 0 {
+		config.LinkMode = "hardlink"
+	}
+	if !isValidLinkMode(config.LinkMode) {
+		Fatalf("Error: Invalid value " + config.LinkMode + " of config setting link_mode or -linkmode parameter, valid values are hardlink, reflink, copy and auto")
+	}
+}
+
+// isValidLinkMode checks if the given value is a supported link_mode setting
+func isValidLinkMode(linkMode string) bool {
+	return linkMode == "hardlink" || linkMode == "reflink" || linkMode == "copy" || linkMode == "auto"
+}
+
+// isValidMirrorMode checks if the given value is a supported mirror_mode setting
+func isValidMirrorMode(mirrorMode string) bool {
+	return mirrorMode == "full" || mirrorMode == "partial" || mirrorMode == "shallow"
+}
+
+// gitModuleTimeout returns the timeout for git commands of the given git module
+func gitModuleTimeout(gm GitModule) int {
+	if !timeoutConfigured(gm.source) {
+		// the implicit default of the timeout setting is too short for local git commands that walk the whole repository
+		return defaultCommandTimeout
+	}
+	if gm.timeout > 0 {
+		return gm.timeout
+	}
+	return config.Timeout
+}
+
+// gitCommandTimeout returns the timeout for git clone, fetch or archive commands of the given git module, the source settings take precedence over the global timeouts setting
+func gitCommandTimeout(gm GitModule, kind string) int {
+	timeouts := config.Timeouts
+	if sa, ok := config.Sources[gm.source]; ok {
+		if sa.Timeouts.Clone > 0 {
+			timeouts.Clone = sa.Timeouts.Clone
+		}
+		if sa.Timeouts.Fetch > 0 {
+			timeouts.Fetch = sa.Timeouts.Fetch
+		}
+		if sa.Timeouts.Archive > 0 {
+			timeouts.Archive = sa.Timeouts.Archive
+		}
+	}
+	timeout := 0
+	switch kind {
+	case "clone":
+		timeout = timeouts.Clone
+	case "fetch":
+		timeout = timeouts.Fetch
+	case "archive":
+		timeout = timeouts.Archive
+	}
+	if timeout > 0 {
+		return timeout
+	}
+	if timeoutConfigured(gm.source) {
+		return gitModuleTimeout(gm)
+	}
+	// the default timeout of only a few seconds is too short for network operations
+	return defaultGitCommandTimeout
+}
+
+// timeoutConfigured checks if the timeout setting is set explicitly in the given source or globally in the g10k config
+func timeoutConfigured(source string) bool {
+	if sa, ok := config.Sources[source]; ok && sa.Timeout > 0 {
+		return true
+	}
+	_, ok := configOrigins["timeout"]
+	return ok
+}
+
+// postrunTimeout returns the timeout for the postrun command, which defaults to an explicitly configured global timeout setting
+func postrunTimeout() int {
+	if config.Timeouts.Postrun > 0 {
+		return config.Timeouts.Postrun
+	}
+	if timeoutConfigured("") {
+		return config.Timeout
+	}
+	return defaultCommandTimeout
+}
+
+// maintenanceTimeout returns the timeout for the maintenance and the fsck of a git mirror, which can take much longer than other local git commands
+func maintenanceTimeout() int {
+	if config.Timeouts.Maintenance > 0 {
+		return config.Timeouts.Maintenance
+	}
+	return defaultMaintenanceTimeout
+}
+
 // preparePuppetfile remove whitespace and comment lines from the given Puppetfile and merges Puppetfile resources that are identified with having a , at the end
 func preparePuppetfile(pf string) string {
 	file, err := os.Open(pf)
@@ -191,6 +737,10 @@ func readPuppetfile(pf string, sshKey string, source string, branch string, forc
 	var n string
 	puppetFile.privateKey = sshKey
 	puppetFile.source = source
+	sa := resolveSourceSettings(config.Sources[source])
+	puppetFile.timeout = sa.Timeout
+	puppetFile.forgeCacheDir = sa.ForgeCacheDir
+	puppetFile.modulesCacheDir = sa.ModulesCacheDir
 	puppetFile.forgeModules = map[string]ForgeModule{}
 	puppetFile.gitModules = map[string]GitModule{}
 	if replacedPuppetfileContent {
@@ -207,7 +757,7 @@ func readPuppetfile(pf string, sshKey string, source string, branch string, forc
 	reForgeModule := regexp.MustCompile(`^\s*(?:mod)\s+['\"]?([^'\"]+[-/][^'\"]+)['\"](?:\s*)[,]?(.*)`)
 	reForgeAttribute := regexp.MustCompile(`\s*['\"]?([^\s'\"]+)\s*['\"]?(?:=>)?\s*['\"]?([^'\"]+)?`)
 	reGitModule := regexp.MustCompile(`^\s*(?:mod)\s+['\"]?([^'\"/]+)['\"]\s*,(.*)`)
-	reGitAttribute := regexp.MustCompile(`\s*:(git|commit|tag|branch|ref|link|ignore[-_]unreachable|fallback|install_path|default_branch|local|use_ssh_agent)\s*=>\s*['\"]?([^'\"]+)['\"]?`)
+	reGitAttribute := regexp.MustCompile(`\s*:(git|commit|tag|branch|ref|link|ignore[-_]unreachable|fallback|install_path|default_branch|local|use_ssh_agent|mirror_mode|submodules|verify_signatures)\s*=>\s*['\"]?([^'\"]+)['\"]?`)
 	reUniqueGitAttribute := regexp.MustCompile(`\s*:(?:commit|tag|branch|ref|link)\s*=>`)
 	reDanglingAttribute := regexp.MustCompile(`^\s*:[^ ]+\s*=>`)
 	moduleDir := "modules"
@@ -216,6 +766,8 @@ func readPuppetfile(pf string, sshKey string, source string, branch string, forc
 		moduleDir = moduleDirParam
 	}
 	var moduleDirs []string
+	explicitSubmodules := make(map[string]bool)
+	explicitVerifySignatures := make(map[string]bool)
 	//nextLineAttr := false
 
 	lines := strings.Split(n, "\n")
@@ -314,7 +866,7 @@ func readPuppetfile(pf string, sshKey string, source string, branch string, forc
 			}
 			// the base url in the Puppetfile takes precedence over an base url specified in the g10k config yaml
 			if len(puppetFile.forgeBaseURL) == 0 {
-				puppetFile.forgeBaseURL = config.ForgeBaseURL
+				puppetFile.forgeBaseURL = sa.ForgeBaseURL
 			}
 			puppetFile.forgeModules[comp[1]] = ForgeModule{version: forgeModuleVersion, name: comp[1], author: comp[0], sha256sum: forgeChecksum, moduleDir: moduleDir, sourceBranch: source + "_" + branch}
 		} else if m := reGitModule.FindStringSubmatch(line); len(m) > 1 {
@@ -412,6 +964,25 @@ func readPuppetfile(pf string, sshKey string, source string, branch string, forc
 							Fatalf("Error: Can not convert value " + a[2] + " of parameter " + gitModuleAttribute + " to boolean. In " + pf + " for module " + gitModuleName + " line: " + line)
 						}
 						gm.useSSHAgent = useSSHAgent
+					} else if gitModuleAttribute == "mirror_mode" {
+						if !isValidMirrorMode(a[2]) {
+							Fatalf("Error: Invalid value " + a[2] + " of parameter " + gitModuleAttribute + ", valid values are full, partial and shallow. In " + pf + " for module " + gitModuleName + " line: " + line)
+						}
+						gm.mirrorMode = a[2]
+					} else if gitModuleAttribute == "submodules" {
+						submodules, err := strconv.ParseBool(a[2])
+						if err != nil {
+							Fatalf("Error: Can not convert value " + a[2] + " of parameter " + gitModuleAttribute + " to boolean. In " + pf + " for module " + gitModuleName + " line: " + line)
+						}
+						gm.submodules = submodules
+						explicitSubmodules[gitModuleName] = true
+					} else if gitModuleAttribute == "verify_signatures" {
+						verifySignatures, err := strconv.ParseBool(a[2])
+						if err != nil {
+							Fatalf("Error: Can not convert value " + a[2] + " of parameter " + gitModuleAttribute + " to boolean. In " + pf + " for module " + gitModuleName + " line: " + line)
+						}
+						gm.verifySignatures = verifySignatures
+						explicitVerifySignatures[gitModuleName] = true
 					}
 
 				}
@@ -443,6 +1014,28 @@ func readPuppetfile(pf string, sshKey string, source string, branch string, forc
 		Validatef()
 	}
 
+	// use the source specific settings for all modules of this Puppetfile
+	for gitModuleName, gm := range puppetFile.gitModules {
+		gm.source = source
+		gm.cacheDir = puppetFile.modulesCacheDir
+		gm.timeout = puppetFile.timeout
+		if len(gm.mirrorMode) == 0 {
+			gm.mirrorMode = sa.MirrorMode
+		}
+		if !explicitSubmodules[gitModuleName] {
+			gm.submodules = sa.Submodules
+		}
+		if !explicitVerifySignatures[gitModuleName] {
+			gm.verifySignatures = sa.VerifySignatures
+		}
+		puppetFile.gitModules[gitModuleName] = gm
+	}
+	for forgeModuleName, fm := range puppetFile.forgeModules {
+		fm.source = source
+		fm.cacheDir = puppetFile.forgeCacheDir
+		puppetFile.forgeModules[forgeModuleName] = fm
+	}
+
 	puppetFile.moduleDirs = moduleDirs
 	puppetFile.sourceBranch = branch
 	// fmt.Printf("%+v\n", puppetFile)
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DeployDiff collects the changes a deploy would apply to all Puppet environments in -diff mode
+type DeployDiff struct {
+	sync.Mutex
+	m map[string]*EnvironmentDiff
+}
+
+// EnvironmentDiff describes the changes a deploy would apply to a single Puppet environment
+type EnvironmentDiff struct {
+	Environment string       `json:"environment"`
+	Action      string       `json:"action"`
+	OldCommit   string       `json:"old_commit,omitempty"`
+	NewCommit   string       `json:"new_commit,omitempty"`
+	Commits     []CommitInfo `json:"commits,omitempty"`
+	Modules     []ModuleDiff `json:"modules,omitempty"`
+}
+
+// ModuleDiff describes the change of a single Puppet module inside a Puppet environment
+type ModuleDiff struct {
+	Name       string       `json:"name"`
+	Type       string       `json:"type"`
+	Action     string       `json:"action"`
+	OldVersion string       `json:"old_version,omitempty"`
+	NewVersion string       `json:"new_version,omitempty"`
+	Commits    []CommitInfo `json:"commits,omitempty"`
+}
+
+// CommitInfo contains the hash and subject line of a single git commit
+type CommitInfo struct {
+	Commit  string `json:"commit"`
+	Subject string `json:"subject"`
+}
+
+// diffEnvironment returns the EnvironmentDiff for the given Puppet environment and creates it if necessary, the caller needs to hold the deployDiff lock
+func diffEnvironment(env string) *EnvironmentDiff {
+	if deployDiff.m == nil {
+		deployDiff.m = make(map[string]*EnvironmentDiff)
+	}
+	if _, ok := deployDiff.m[env]; !ok {
+		deployDiff.m[env] = &EnvironmentDiff{Environment: env, Action: "update"}
+	}
+	return deployDiff.m[env]
+}
+
+// recordEnvironmentDiff stores the control repository change of the given Puppet environment
+func recordEnvironmentDiff(env string, action string, oldCommit string, newCommit string, commits []CommitInfo) {
+	deployDiff.Lock()
+	defer deployDiff.Unlock()
+	ed := diffEnvironment(env)
+	ed.Action = action
+	ed.OldCommit = oldCommit
+	ed.NewCommit = newCommit
+	ed.Commits = commits
+}
+
+// recordModuleDiff stores the change of a single Puppet module of the given Puppet environment
+func recordModuleDiff(env string, md ModuleDiff) {
+	deployDiff.Lock()
+	defer deployDiff.Unlock()
+	ed := diffEnvironment(env)
+	ed.Modules = append(ed.Modules, md)
+}
+
+// recordGitDiff stores the change of a git module or control repository that syncToModuleDir() detected
+func recordGitDiff(gitDir string, targetDir string, oldCommit string, newCommit string, isControlRepo bool, env string) {
+	commits := []CommitInfo{}
+	if len(oldCommit) > 0 {
+		commits = gitCommitsBetween(gitDir, oldCommit, newCommit)
+	}
+	if isControlRepo {
+		action := "update"
+		if !isDir(targetDir) {
+			action = "create"
+		}
+		recordEnvironmentDiff(env, action, oldCommit, newCommit, commits)
+		return
+	}
+	action := "update"
+	if len(oldCommit) == 0 {
+		action = "add"
+	}
+	recordModuleDiff(env, ModuleDiff{Name: filepath.Base(targetDir), Type: "git", Action: action, OldVersion: oldCommit, NewVersion: newCommit, Commits: commits})
+}
+
+// recordRemovedModuleDiff stores the removal of an unmanaged module directory
+func recordRemovedModuleDiff(dir string, allPuppetfiles map[string]Puppetfile) {
+	for env, pf := range allPuppetfiles {
+		if !strings.HasPrefix(dir, pf.workDir+"/") {
+			continue
+		}
+		md := ModuleDiff{Name: filepath.Base(dir), Type: "unknown", Action: "remove"}
+		if fileExists(filepath.Join(dir, ".latest_commit")) {
+			content, _ := ioutil.ReadFile(filepath.Join(dir, ".latest_commit"))
+			md.Type = "git"
+			md.OldVersion = strings.TrimSpace(string(content))
+		} else if fileExists(filepath.Join(dir, "metadata.json")) {
+			md.Type = "forge"
+			md.OldVersion = readModuleMetadata(filepath.Join(dir, "metadata.json")).version
+		}
+		recordModuleDiff(env, md)
+		return
+	}
+}
+
+// gitCommitsBetween returns the commits that are reachable from newCommit, but not from oldCommit
+func gitCommitsBetween(gitDir string, oldCommit string, newCommit string) []CommitInfo {
+	commits := []CommitInfo{}
+	er := executeCommand("git --git-dir "+gitDir+" log --format=%H%x09%s "+oldCommit+".."+newCommit, "", gitCommandTimeout(GitModule{}, "archive"), true, false)
+	if er.returnCode != 0 {
+		Debugf("Could not determine commits between " + oldCommit + " and " + newCommit + " in " + gitDir + " Error: " + er.output)
+		return commits
+	}
+	for _, line := range strings.Split(strings.TrimSpace(er.output), "\n") {
+		if parts := strings.SplitN(line, "\t", 2); len(parts) == 2 {
+			commits = append(commits, CommitInfo{Commit: parts[0], Subject: parts[1]})
+		}
+	}
+	return commits
+}
+
+// extractPuppetfileFromGit writes the Puppetfile of the given branch in the control repository mirror to a temporary file and returns its path
+func extractPuppetfileFromGit(gitDir string, branch string) string {
+	er := executeCommand("git --git-dir "+gitDir+" show "+branch+":Puppetfile", "", gitModuleTimeout(GitModule{}), true, false)
+	if er.returnCode != 0 {
+		return ""
+	}
+	f, err := ioutil.TempFile("", "g10k-diff-Puppetfile-")
+	if err != nil {
+		Fatalf("extractPuppetfileFromGit(): Error while creating temporary Puppetfile Error: " + err.Error())
+	}
+	defer f.Close()
+	if _, err := f.WriteString(er.output); err != nil {
+		os.Remove(f.Name())
+		Fatalf("extractPuppetfileFromGit(): Error while writing temporary Puppetfile " + f.Name() + " Error: " + err.Error())
+	}
+	return f.Name()
+}
+
+// deployDiffHasChanges returns true if any Puppet environment would be changed
+func deployDiffHasChanges() bool {
+	deployDiff.Lock()
+	defer deployDiff.Unlock()
+	return len(deployDiff.m) > 0
+}
+
+// sortedDeployDiff returns all recorded environment changes sorted by environment and module name
+func sortedDeployDiff() []EnvironmentDiff {
+	deployDiff.Lock()
+	defer deployDiff.Unlock()
+	envs := []EnvironmentDiff{}
+	for _, ed := range deployDiff.m {
+		sort.Slice(ed.Modules, func(i, j int) bool {
+			return ed.Modules[i].Name < ed.Modules[j].Name
+		})
+		envs = append(envs, *ed)
+	}
+	sort.Slice(envs, func(i, j int) bool {
+		return envs[i].Environment < envs[j].Environment
+	})
+	return envs
+}
+
+// shortCommit shortens git commit hashes for the text output
+func shortCommit(commit string) string {
+	if len(commit) == 40 {
+		return commit[:7]
+	}
+	return commit
+}
+
+// printDeployDiff prints the collected deploy plan either as text or as JSON
+func printDeployDiff(format string) {
+	envs := sortedDeployDiff()
+	if format == "json" {
+		content, err := json.MarshalIndent(map[string][]EnvironmentDiff{"environments": envs}, "", "  ")
+		if err != nil {
+			Fatalf("printDeployDiff(): Could not encode deploy diff as JSON Error: " + err.Error())
+		}
+		fmt.Println(string(content))
+		return
+	} else if format != "text" {
+		Fatalf("Error: unknown -diffformat " + format + " Valid formats are text and json")
+	}
+
+	if len(envs) == 0 {
+		fmt.Println("No changes")
+		return
+	}
+	symbols := map[string]string{"create": "+", "add": "+", "update": "~", "purge": "-", "remove": "-"}
+	for _, ed := range envs {
+		fmt.Println(symbols[ed.Action] + " environment " + ed.Environment + " (" + ed.Action + ")")
+		if len(ed.NewCommit) > 0 {
+			if len(ed.OldCommit) > 0 {
+				fmt.Println("    control repository: " + shortCommit(ed.OldCommit) + " -> " + shortCommit(ed.NewCommit))
+			} else {
+				fmt.Println("    control repository: " + shortCommit(ed.NewCommit))
+			}
+			for _, c := range ed.Commits {
+				fmt.Println("        " + shortCommit(c.Commit) + " " + c.Subject)
+			}
+		}
+		for _, md := range ed.Modules {
+			line := "    " + symbols[md.Action] + " " + md.Type + " module " + md.Name
+			if len(md.OldVersion) > 0 && len(md.NewVersion) > 0 {
+				line += " " + shortCommit(md.OldVersion) + " -> " + shortCommit(md.NewVersion)
+			} else if len(md.NewVersion) > 0 {
+				line += " " + shortCommit(md.NewVersion)
+			} else if len(md.OldVersion) > 0 {
+				line += " " + shortCommit(md.OldVersion)
+			}
+			fmt.Println(line)
+			for _, c := range md.Commits {
+				fmt.Println("        " + shortCommit(c.Commit) + " " + c.Subject)
+			}
+		}
+	}
+}
+
+// removeTempPuppetfile removes the temporary Puppetfile created in -diff mode
+func removeTempPuppetfile(pf string) {
+	if err := os.Remove(pf); err != nil {
+		Debugf("Could not remove temporary Puppetfile " + pf + " Error: " + err.Error())
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EnvironmentFingerprint contains the floating references, the module directories and the settings hash of a deployed Puppet environment, which together with the control repo commit and the Puppetfile checksum of the deploy file decide if the environment needs to be synced again
+type EnvironmentFingerprint struct {
+	SettingsHash       string           `json:"settings_hash"`
+	ModuleDirs         []string         `json:"module_dirs"`
+	FloatingRefs       []FloatingGitRef `json:"floating_refs"`
+	LatestForgeModules []string         `json:"latest_forge_modules,omitempty"`
+	ForgeCacheTTL      string           `json:"forge_cache_ttl,omitempty"`
+}
+
+// FloatingGitRef is a git module reference that can point to a different commit after a mirror update, like a branch or the default branch
+type FloatingGitRef struct {
+	Git        string `json:"git"`
+	Ref        string `json:"ref"`
+	MirrorMode string `json:"mirror_mode,omitempty"`
+	Commit     string `json:"commit"`
+}
+
+// floatingGitRefs contains the resolved floating git references of each Puppet environment of this g10k run
+var floatingGitRefs = struct {
+	sync.Mutex
+	m map[string][]FloatingGitRef
+}{m: make(map[string][]FloatingGitRef)}
+
+// fingerprintMirrors contains the result of the mirror updates done to check the floating references of unchanged environments
+var fingerprintMirrors = struct {
+	sync.Mutex
+	m map[string]bool
+}{m: make(map[string]bool)}
+
+// recordFloatingGitRef remembers the commit the given floating git module reference resolved to in the given Puppet environment, an empty commit means that the reference does not exist
+func recordFloatingGitRef(gitModule GitModule, env string, commit string) {
+	if len(gitModule.commit) > 0 || len(gitModule.tag) > 0 {
+		return
+	}
+	floatingGitRefs.Lock()
+	floatingGitRefs.m[env] = append(floatingGitRefs.m[env], FloatingGitRef{Git: gitModule.git, Ref: gitModule.tree, MirrorMode: gitModule.mirrorMode, Commit: commit})
+	floatingGitRefs.Unlock()
+}
+
+// environmentSettingsHash returns the sha256 sum of all global, source and command line settings that change the content of a synced Puppet environment of the given source
+func environmentSettingsHash(ssa Source) string {
+	settings := struct {
+		Source                   Source
+		PurgeLevels              []string
+		PurgeAllowList           []string
+		DeploymentPurgeAllowList []string
+		PurgeSkiplist            []string
+		CloneGitModules          bool
+		LinkMode                 string
+		ForgeBaseURL             string
+		ModuleDirParam           string
+		ErrorMissingLFSObject    bool
+		GenerateTypes            bool
+	}{ssa, config.PurgeLevels, config.PurgeAllowList, config.DeploymentPurgeAllowList, config.PurgeSkiplist,
+		config.CloneGitModules, config.LinkMode, config.ForgeBaseURL, moduleDirParam, config.ErrorMissingLFSObject, config.GenerateTypes}
+	content, err := json.Marshal(settings)
+	if err != nil {
+		Fatalf("environmentSettingsHash(): Error while encoding the settings Error: " + err.Error())
+	}
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// environmentFingerprint returns the fingerprint of the given synced Puppet environment
+func environmentFingerprint(env string, pf Puppetfile) *EnvironmentFingerprint {
+	ef := &EnvironmentFingerprint{ModuleDirs: []string{}, FloatingRefs: []FloatingGitRef{}}
+	if sa, ok := config.Sources[pf.source]; ok {
+		ef.SettingsHash = environmentSettingsHash(resolveSourceSettings(sa))
+	}
+	for gitName, gm := range pf.gitModules {
+		if gm.local {
+			continue
+		}
+		if rel, err := filepath.Rel(pf.workDir, deployedGitModuleDir(pf, gitName, gm)); err == nil {
+			ef.ModuleDirs = append(ef.ModuleDirs, rel)
+		}
+	}
+	for _, fm := range pf.forgeModules {
+		ef.ModuleDirs = append(ef.ModuleDirs, filepath.Join(fm.moduleDir, fm.name))
+	}
+	sort.Strings(ef.ModuleDirs)
+	floatingGitRefs.Lock()
+	ef.FloatingRefs = append(ef.FloatingRefs, floatingGitRefs.m[env]...)
+	floatingGitRefs.Unlock()
+	sort.Slice(ef.FloatingRefs, func(i, j int) bool {
+		if ef.FloatingRefs[i].Git != ef.FloatingRefs[j].Git {
+			return ef.FloatingRefs[i].Git < ef.FloatingRefs[j].Git
+		}
+		return ef.FloatingRefs[i].Ref < ef.FloatingRefs[j].Ref
+	})
+	for _, fm := range pf.forgeModules {
+		if fm.version == "latest" {
+			ef.LatestForgeModules = append(ef.LatestForgeModules, fm.author+"-"+fm.name)
+		}
+	}
+	sort.Strings(ef.LatestForgeModules)
+	if len(ef.LatestForgeModules) > 0 {
+		forgeCacheTTL := config.ForgeCacheTTL
+		if pf.forgeCacheTTL != 0 {
+			forgeCacheTTL = pf.forgeCacheTTL
+		}
+		ef.ForgeCacheTTL = forgeCacheTTL.String()
+	}
+	return ef
+}
+
+// resolveGitObject returns the object the given reference points to in the given git repository or an empty string if it does not exist
+func resolveGitObject(gitDir string, ref string, timeout int) string {
+	revParseCmd := "git --git-dir " + gitDir + " rev-parse --verify '" + ref
+	if !config.GitObjectSyntaxNotSupported {
+		revParseCmd = revParseCmd + "^{object}'"
+	} else {
+		revParseCmd = revParseCmd + "'"
+	}
+	er := executeCommand(revParseCmd, "", timeout, true, false)
+	if er.returnCode != 0 {
+		return ""
+	}
+	return strings.TrimSuffix(er.output, "\n")
+}
+
+// updateFingerprintMirror updates the mirror of the given floating git reference at most once per g10k run
+func updateFingerprintMirror(gm GitModule, workDir string) bool {
+	key := workDir
+	if gm.mirrorMode == "shallow" {
+		// shallow mirrors only contain the fetched references
+		key = workDir + ":" + strings.Join(gm.refs, ",")
+	}
+	lockGitDir(workDir)
+	defer unlockGitDir(workDir)
+	fingerprintMirrors.Lock()
+	success, ok := fingerprintMirrors.m[key]
+	fingerprintMirrors.Unlock()
+	if ok {
+		return success
+	}
+	success = doMirrorOrUpdate(gm, workDir, 0)
+	fingerprintMirrors.Lock()
+	fingerprintMirrors.m[key] = success
+	fingerprintMirrors.Unlock()
+	return success
+}
+
+// environmentUnchanged checks if the fingerprint of the deployed Puppet environment still matches the g10k settings, its module directories, the control repo commit, its Puppetfile and the floating git references, the returned reason explains why the environment needs to be synced
+func environmentUnchanged(sa Source, ssa Source, source string, workDir string, branch string, targetDir string) (bool, string) {
+	if force {
+		return false, "-force is set"
+	}
+	if len(moduleParam) > 0 {
+		return false, "-module is set"
+	}
+	if check4update {
+		return false, "-check4update is set"
+	}
+	deployFile := filepath.Join(targetDir, ".g10k-deploy.json")
+	if !fileExists(deployFile) {
+		return false, "deploy file " + deployFile + " does not exist"
+	}
+	dr := readDeployResultFile(deployFile)
+	if !dr.DeploySuccess {
+		return false, "the last deployment did not finish successfully"
+	}
+	if dr.Fingerprint == nil {
+		return false, "deploy file " + deployFile + " does not contain a fingerprint"
+	}
+	if dr.Fingerprint.SettingsHash != environmentSettingsHash(ssa) {
+		return false, "the g10k settings changed"
+	}
+	for _, moduleDir := range dr.Fingerprint.ModuleDirs {
+		if !isDir(filepath.Join(targetDir, moduleDir)) {
+			return false, "module directory " + filepath.Join(targetDir, moduleDir) + " does not exist"
+		}
+	}
+	if commit := resolveGitObject(workDir, branch, gitModuleTimeout(GitModule{source: source, timeout: ssa.Timeout})); commit != dr.Signature {
+		return false, "control repo commit changed from " + dr.Signature + " to " + commit
+	}
+	checksum := ""
+	if pf := filepath.Join(targetDir, "Puppetfile"); fileExists(pf) {
+		checksum = getSha256sumFile(pf)
+	}
+	if checksum != dr.PuppetfileChecksum {
+		return false, "Puppetfile checksum changed from " + dr.PuppetfileChecksum + " to " + checksum
+	}
+	if len(dr.Fingerprint.LatestForgeModules) > 0 {
+		forgeCacheTTL, err := time.ParseDuration(dr.Fingerprint.ForgeCacheTTL)
+		if err != nil || forgeCacheTTL <= 0 {
+			return false, "Forge modules with version latest need to be checked without forge_cache_ttl"
+		}
+		for _, moduleName := range dr.Fingerprint.LatestForgeModules {
+			lastCheckedFile := filepath.Join(forgeCacheDir(ForgeModule{cacheDir: ssa.ForgeCacheDir, baseURL: ssa.ForgeBaseURL}), moduleName+"-latest-last-checked")
+			fileInfo, err := os.Stat(lastCheckedFile)
+			if err != nil || time.Since(fileInfo.ModTime()) > forgeCacheTTL {
+				return false, "latest version of Forge module " + moduleName + " was not checked in the last " + forgeCacheTTL.String()
+			}
+		}
+	}
+	for _, ref := range dr.Fingerprint.FloatingRefs {
+		gm := GitModule{git: ref.Git, privateKey: sa.PrivateKey, source: source, cacheDir: ssa.ModulesCacheDir, timeout: ssa.Timeout, mirrorMode: ref.MirrorMode, refs: []string{ref.Ref}}
+		moduleCacheDir := gitModuleCacheDir(gm)
+		if !updateFingerprintMirror(gm, moduleCacheDir) {
+			return false, "could not update git mirror " + moduleCacheDir
+		}
+		if commit := resolveGitObject(moduleCacheDir, ref.Ref, gitModuleTimeout(gm)); commit != ref.Commit {
+			return false, "reference " + ref.Ref + " of git module " + ref.Git + " changed from " + ref.Commit + " to " + commit
+		}
+	}
+	return true, "control repo commit, Puppetfile and floating git references are unchanged"
+}
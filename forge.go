@@ -1,9 +1,9 @@
 package main
 
 import (
-	"crypto/md5"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -13,7 +13,6 @@ import (
 	"strconv"
 	"strings"
 	"sync"
-	"syscall"
 	"time"
 
 	"github.com/fatih/color"
@@ -46,9 +45,9 @@ func checkDeprecation(fm ForgeModule, lastCheckedFile string) bool {
 func doModuleInstallOrNothing(fm ForgeModule) {
 	moduleName := fm.author + "-" + fm.name
 	moduleVersion := fm.version
-	workDir := filepath.Join(config.ForgeCacheDir, moduleName+"-"+fm.version)
-	lastCheckedFile := filepath.Join(config.ForgeCacheDir, moduleName+"-latest-last-checked")
-	fr := ForgeResult{false, fm.version, "", 0}
+	workDir := filepath.Join(forgeCacheDir(fm), moduleName+"-"+fm.version)
+	lastCheckedFile := filepath.Join(forgeCacheDir(fm), moduleName+"-latest-last-checked")
+	fr := ForgeResult{false, fm.version, "", 0, "", false}
 	if check4update {
 		moduleVersion = "latest"
 	}
@@ -61,7 +60,7 @@ func doModuleInstallOrNothing(fm ForgeModule) {
 				if _, ok := uniqueForgeModules[moduleName+"-"+fr.versionNumber]; ok {
 					Debugf("no need to fetch Forge module " + moduleName + " in latest, because latest is " + fr.versionNumber + " and that will already be fetched")
 					fr.needToGet = false
-					versionDir := filepath.Join(config.ForgeCacheDir, moduleName+"-"+fr.versionNumber)
+					versionDir := filepath.Join(forgeCacheDir(fm), moduleName+"-"+fr.versionNumber)
 					absolutePath, err := filepath.Abs(versionDir)
 					Debugf("trying to create symlink " + workDir + " pointing to " + absolutePath)
 					if err != nil {
@@ -107,7 +106,7 @@ func doModuleInstallOrNothing(fm ForgeModule) {
 
 	} else if moduleVersion == "present" {
 		// ensure that a latest version this module exists
-		latestDir := filepath.Join(config.ForgeCacheDir, moduleName+"-latest")
+		latestDir := filepath.Join(forgeCacheDir(fm), moduleName+"-latest")
 		if !isDir(latestDir) {
 			if _, ok := uniqueForgeModules[moduleName+"-latest"]; ok {
 				Debugf("we got " + fm.author + "-" + fm.name + "-" + fm.version + ", but no " + latestDir + " to use, but -latest is already being fetched.")
@@ -121,7 +120,9 @@ func doModuleInstallOrNothing(fm ForgeModule) {
 		Debugf("Nothing to do for module " + fm.author + "-" + fm.name + "-" + fm.version + ", because " + latestDir + " exists")
 	} else {
 		if !isDir(workDir) {
-			_ = queryForgeAPI(fm)
+			// the release metadata of the pinned version contains its checksum, its file size and the deprecation of the module,
+			// so that the module endpoint does not need to be queried
+			fr = lookupForgeRelease(fm, fm.version)
 			fr.needToGet = true
 		} else {
 			if !checkDeprecation(fm, lastCheckedFile) {
@@ -141,14 +142,14 @@ func doModuleInstallOrNothing(fm ForgeModule) {
 		} else {
 			// os.Readlink error is okay
 			versionDir, _ := os.Readlink(workDir)
-			if versionDir == filepath.Join(config.ForgeCacheDir, moduleName+"-"+fr.versionNumber) {
+			if versionDir == filepath.Join(forgeCacheDir(fm), moduleName+"-"+fr.versionNumber) {
 				Debugf("No reason to re-symlink again")
 			} else {
 				if isDir(workDir) {
 					Debugf("Trying to remove symlink: " + workDir)
 					_ = os.Remove(workDir)
 				}
-				versionDir = filepath.Join(config.ForgeCacheDir, moduleName+"-"+fr.versionNumber)
+				versionDir = filepath.Join(forgeCacheDir(fm), moduleName+"-"+fr.versionNumber)
 				absolutePath, err := filepath.Abs(versionDir)
 				if err != nil {
 					Fatalf("doModuleInstallOrNothing(): Error while resolving absolute file path for " + versionDir + " Error: " + err.Error())
@@ -159,7 +160,7 @@ func doModuleInstallOrNothing(fm ForgeModule) {
 				}
 			}
 		}
-		downloadForgeModule(moduleName, fr.versionNumber, fm, 1)
+		downloadForgeModule(moduleName, fr.versionNumber, fm, fr, 1)
 	}
 
 }
@@ -170,25 +171,27 @@ func queryForgeAPI(fm ForgeModule) ForgeResult {
 		baseURL = fm.baseURL
 	}
 	url := baseURL + "/v3/modules/" + fm.author + "-" + fm.name + "?exclude_fields=changelog+readme+license+releases"
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequestWithContext(workCtx, "GET", url, nil)
 	if err != nil {
 		Fatalf("queryForgeAPI(): Error creating GET request for Puppetlabs forge API" + err.Error())
 	}
 	req.Header.Set("User-Agent", "https://github.com/xorpaul/g10k/")
 	req.Header.Set("Connection", "keep-alive")
 
-	proxyURL, err := http.ProxyFromEnvironment(req)
+	proxyURL, err := httpProxyFunc(forgeProxy())(req)
 	if err != nil {
-		Fatalf("queryForgeAPI(): Error while getting http proxy with golang http.ProxyFromEnvironment()" + err.Error())
+		Fatalf("queryForgeAPI(): Error while getting http proxy for request Error: " + err.Error())
 	}
 	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	releaseHost := acquireForgeHost(fm)
+	defer releaseHost()
 	before := time.Now()
 	resp, err := client.Do(req)
 	if err != nil {
 		if config.UseCacheFallback {
 			Warnf("Forge API error, trying to use cache for module " + fm.author + "/" + fm.author + "-" + fm.name)
 			_ = getLatestCachedModule(fm)
-			return ForgeResult{false, "", "", 0}
+			return ForgeResult{false, "", "", 0, "", false}
 		}
 		Fatalf("queryForgeAPI(): Error while issuing the HTTP request to " + url + " Error: " + err.Error())
 	}
@@ -210,23 +213,23 @@ func queryForgeAPI(fm ForgeModule) ForgeResult {
 		json := string(body)
 		fr := parseForgeAPIResult(json, fm)
 
-		lastCheckedFile := filepath.Join(config.ForgeCacheDir, fm.author+"-"+fm.name+"-latest-last-checked")
+		lastCheckedFile := filepath.Join(forgeCacheDir(fm), fm.author+"-"+fm.name+"-latest-last-checked")
 		Debugf("writing last-checked file " + lastCheckedFile)
-		f, _ := os.Create(lastCheckedFile)
-		defer f.Close()
-		f.WriteString(json)
+		if err := writeFileAtomic(lastCheckedFile, []byte(json), 0644); err != nil {
+			Debugf("Could not write last-checked file " + lastCheckedFile + " Error: " + err.Error())
+		}
 
-		return ForgeResult{true, fr.versionNumber, fr.md5sum, fr.fileSize}
+		return fr
 
 	} else if resp.StatusCode == http.StatusNotModified {
 		Debugf("Got 304 nothing to do for module " + fm.author + "-" + fm.name)
-		return ForgeResult{false, "", "", 0}
+		return ForgeResult{false, "", "", 0, "", false}
 	} else if resp.StatusCode == http.StatusNotFound {
 		Fatalf("Received 404 from Forge for module " + fm.author + "-" + fm.name + " using URL " + url + " Does the module really exist and is it correctly named?")
-		return ForgeResult{false, "", "", 0}
+		return ForgeResult{false, "", "", 0, "", false}
 	}
 	Fatalf("Unexpected response code " + resp.Status)
-	return ForgeResult{false, "", "", 0}
+	return ForgeResult{false, "", "", 0, "", false}
 }
 
 // parseForgeAPIResult parses the JSON response of the Forge API
@@ -241,25 +244,14 @@ func parseForgeAPIResult(json string, fm ForgeModule) ForgeResult {
 	version := currentRelease["version"].String()
 	modulemd5sum := currentRelease["file_md5"].String()
 	moduleFilesize := currentRelease["file_size"].Int()
+	moduleSha256sum := currentRelease["file_sha256"].String()
 
 	mutex.Lock()
 	forgeJSONParseTime += duration
 	mutex.Unlock()
 
 	if deprecatedTimestamp.Exists() && deprecatedTimestamp.Value() != nil {
-		supersededText := ""
-		if successorModule["slug"].Exists() {
-			supersededText = " The author has suggested " + successorModule["slug"].String() + " as its replacement"
-		}
-		// check the verbosity level
-		// otherwise these warnings mess up the progress bars
-		if info || debug {
-			Warnf("WARN: Forge module " + fm.author + "-" + fm.name + " has been deprecated by its author since " + deprecatedTimestamp.String() + supersededText)
-		} else {
-			mutex.Lock()
-			forgeModuleDeprecationNotice += "WARN: Forge module " + fm.author + "-" + fm.name + " has been deprecated by its author since " + deprecatedTimestamp.String() + supersededText + "\n"
-			mutex.Unlock()
-		}
+		warnForgeModuleDeprecation(fm, deprecatedTimestamp.String(), successorModule["slug"].String())
 	}
 
 	if len(version) < 1 {
@@ -271,27 +263,55 @@ func parseForgeAPIResult(json string, fm ForgeModule) ForgeResult {
 	latestForgeModules.m[fm.author+"-"+fm.name] = version
 	latestForgeModules.Unlock()
 
-	return ForgeResult{true, version, modulemd5sum, moduleFilesize}
+	return ForgeResult{true, version, modulemd5sum, moduleFilesize, moduleSha256sum, true}
+}
+
+// warnForgeModuleDeprecation warns about the deprecation of the given Forge module and its suggested replacement
+func warnForgeModuleDeprecation(fm ForgeModule, deprecatedAt string, successor string) {
+	supersededText := ""
+	if len(successor) > 0 {
+		supersededText = " The author has suggested " + successor + " as its replacement"
+	}
+	// check the verbosity level
+	// otherwise these warnings mess up the progress bars
+	if info || debug {
+		Warnf("WARN: Forge module " + fm.author + "-" + fm.name + " has been deprecated by its author since " + deprecatedAt + supersededText)
+	} else {
+		mutex.Lock()
+		forgeModuleDeprecationNotice += "WARN: Forge module " + fm.author + "-" + fm.name + " has been deprecated by its author since " + deprecatedAt + supersededText + "\n"
+		mutex.Unlock()
+	}
 }
 
 // getMetadataForgeModule queries the configured Puppet Forge and return
 func getMetadataForgeModule(fm ForgeModule) ForgeModule {
+	fmm, err := queryForgeRelease(fm)
+	if err != nil {
+		Fatalf("getMetadataForgeModule(): " + err.Error())
+	}
+	return fmm
+}
+
+// queryForgeRelease returns the checksums and the file size of the given Forge module version from the release metadata of the Forge
+func queryForgeRelease(fm ForgeModule) (ForgeModule, error) {
 	baseURL := config.ForgeBaseURL
 	if len(fm.baseURL) > 0 {
 		baseURL = fm.baseURL
 	}
 	url := baseURL + "/v3/releases/" + fm.author + "-" + fm.name + "-" + fm.version
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequestWithContext(workCtx, "GET", url, nil)
 	if err != nil {
-		Fatalf("getMetadataForgeModule(): Error while creating GET http request with url " + url + " Error: " + err.Error())
+		return ForgeModule{}, errors.New("Error while creating GET http request with url " + url + " Error: " + err.Error())
 	}
 	req.Header.Set("User-Agent", "https://github.com/xorpaul/g10k/")
 	req.Header.Set("Connection", "keep-alive")
-	proxyURL, err := http.ProxyFromEnvironment(req)
+	proxyURL, err := httpProxyFunc(forgeProxy())(req)
 	if err != nil {
-		Fatalf("getMetadataForgeModule(): Error while getting http proxy with golang http.ProxyFromEnvironment()" + err.Error())
+		return ForgeModule{}, errors.New("Error while getting http proxy for request Error: " + err.Error())
 	}
 	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	releaseHost := acquireForgeHost(fm)
+	defer releaseHost()
 	before := time.Now()
 	Debugf("GETing " + url)
 	resp, err := client.Do(req)
@@ -301,42 +321,44 @@ func getMetadataForgeModule(fm ForgeModule) ForgeModule {
 	syncForgeTime += duration
 	mutex.Unlock()
 	if err != nil {
-		Fatalf("getMetadataForgeModule(): Error while querying metadata for Forge module " + fm.name + " from " + url + ": " + err.Error())
+		return ForgeModule{}, errors.New("Error while querying metadata for Forge module " + fm.name + " from " + url + ": " + err.Error())
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode == http.StatusOK {
-		body, err := ioutil.ReadAll(resp.Body)
-
-		if err != nil {
-			Fatalf("getMetadataForgeModule(): Error while reading response body for Forge module " + fm.name + " from " + url + ": " + err.Error())
-		}
+	if resp.StatusCode != http.StatusOK {
+		return ForgeModule{}, errors.New("Unexpected response code while GETing " + url + " " + resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return ForgeModule{}, errors.New("Error while reading response body for Forge module " + fm.name + " from " + url + ": " + err.Error())
+	}
 
-		before := time.Now()
-		currentRelease := gjson.Parse(string(body)).Map()
-		duration := time.Since(before).Seconds()
-		modulemd5sum := currentRelease["file_md5"].String()
-		moduleFilesize := currentRelease["file_size"].Int()
-		Debugf("module: " + fm.author + "/" + fm.name + " modulemd5sum: " + modulemd5sum + " moduleFilesize: " + strconv.FormatInt(moduleFilesize, 10))
+	before = time.Now()
+	currentRelease := gjson.Parse(string(body)).Map()
+	duration = time.Since(before).Seconds()
+	modulemd5sum := currentRelease["file_md5"].String()
+	moduleFilesize := currentRelease["file_size"].Int()
+	moduleSha256sum := currentRelease["file_sha256"].String()
+	if deprecatedTimestamp := gjson.Get(string(body), "module.deprecated_at"); deprecatedTimestamp.Exists() && deprecatedTimestamp.Value() != nil {
+		warnForgeModuleDeprecation(fm, deprecatedTimestamp.String(), "")
+	}
+	Debugf("module: " + fm.author + "/" + fm.name + " modulemd5sum: " + modulemd5sum + " moduleSha256sum: " + moduleSha256sum + " moduleFilesize: " + strconv.FormatInt(moduleFilesize, 10))
 
-		mutex.Lock()
-		forgeJSONParseTime += duration
-		mutex.Unlock()
+	mutex.Lock()
+	forgeJSONParseTime += duration
+	mutex.Unlock()
 
-		return ForgeModule{md5sum: modulemd5sum, fileSize: moduleFilesize}
-	}
-	Fatalf("getMetadataForgeModule(): Unexpected response code while GETing " + url + " " + resp.Status)
-	return ForgeModule{}
+	return ForgeModule{md5sum: modulemd5sum, fileSize: moduleFilesize, sha256sum: moduleSha256sum}, nil
 }
 
-func extractForgeModule(wgForgeModule *sync.WaitGroup, file *io.PipeReader, fileName string) {
+func extractForgeModule(wgForgeModule *sync.WaitGroup, file *io.PipeReader, fileName string, cacheDir string) {
 	defer wgForgeModule.Done()
 	funcName := funcName()
 
 	before := time.Now()
 	fileReader, err := pgzip.NewReader(file)
 
-	unTar(fileReader, config.ForgeCacheDir)
+	unTar(fileReader, cacheDir)
 
 	if err != nil {
 		Fatalf(funcName + "(): pgzip reader error for module " + fileName + " error:" + err.Error())
@@ -344,13 +366,14 @@ func extractForgeModule(wgForgeModule *sync.WaitGroup, file *io.PipeReader, file
 	defer fileReader.Close()
 
 	duration := time.Since(before).Seconds()
-	Verbosef("Extracting " + filepath.Join(config.ForgeCacheDir, fileName) + " took " + strconv.FormatFloat(duration, 'f', 5, 64) + "s")
+	Verbosef("Extracting " + filepath.Join(cacheDir, fileName) + " took " + strconv.FormatFloat(duration, 'f', 5, 64) + "s")
 	mutex.Lock()
 	ioForgeTime += duration
 	mutex.Unlock()
 }
 
-func downloadForgeModule(name string, version string, fm ForgeModule, retryCount int) {
+// downloadForgeModule downloads and extracts the Forge module archive and verifies its sha256 sum and file size while streaming
+func downloadForgeModule(name string, version string, fm ForgeModule, fr ForgeResult, retryCount int) {
 	funcName := funcName()
 	var wgForgeModule sync.WaitGroup
 
@@ -360,23 +383,36 @@ func downloadForgeModule(name string, version string, fm ForgeModule, retryCount
 	//url := "https://forgeapi.puppet.com/v3/files/puppetlabs-apt-2.1.1.tar.gz"
 	fileName := name + "-" + version + ".tar.gz"
 
-	if !isDir(filepath.Join(config.ForgeCacheDir, name+"-"+version)) {
+	hashSha256 := sha256.New()
+	var calculatedArchiveSize int64
+	// a short write of the archive, e.g. on a full disk, does not change the sha256 sum of the downloaded stream
+	var saveErr error
+	downloaded := false
+	moduleDir := filepath.Join(forgeCacheDir(fm), name+"-"+version)
+	tempDir := ""
+	releaseHost := func() {}
+	if !isDir(moduleDir) {
+		downloaded = true
+		// download and extract into a temporary directory, so that an interrupted run never leaves a module dir that looks complete
+		tempDir = createTempDir(moduleDir)
 		baseURL := config.ForgeBaseURL
 		if len(fm.baseURL) > 0 {
 			baseURL = fm.baseURL
 		}
 		url := baseURL + "/v3/files/" + fileName
-		req, err := http.NewRequest("GET", url, nil)
+		req, err := http.NewRequestWithContext(workCtx, "GET", url, nil)
 		if err != nil {
 			Fatalf("getMetadataForgeModule(): Error while creating GET http request with url " + url + " Error: " + err.Error())
 		}
 		req.Header.Set("User-Agent", "https://github.com/xorpaul/g10k/")
 		req.Header.Set("Connection", "close")
-		proxyURL, err := http.ProxyFromEnvironment(req)
+		proxyURL, err := httpProxyFunc(forgeProxy())(req)
 		if err != nil {
-			Fatalf(funcName + "(): Error while getting http proxy with golang http.ProxyFromEnvironment()" + err.Error())
+			Fatalf(funcName + "(): Error while getting http proxy for request Error: " + err.Error())
 		}
 		client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+		// the host stays taken until the archive is completely downloaded
+		releaseHost = acquireForgeHost(fm)
 		before := time.Now()
 		Debugf("GETing " + url)
 		resp, err := client.Do(req)
@@ -394,18 +430,24 @@ func downloadForgeModule(name string, version string, fm ForgeModule, retryCount
 			wgForgeModule.Add(1)
 			go func() {
 				defer wgForgeModule.Done()
-				targetFileName := filepath.Join(config.ForgeCacheDir, fileName)
+				targetFileName := filepath.Join(tempDir, fileName)
 				Debugf(funcName + "(): Trying to create " + targetFileName)
 				out, err := os.Create(targetFileName)
 				if err != nil {
 					Fatalf(funcName + "(): Error while creating file for Forge module " + targetFileName + " Error: " + err.Error())
 				}
-				defer out.Close()
-				io.Copy(out, saveFileR)
+				if _, err := io.Copy(out, saveFileR); err != nil {
+					saveErr = err
+					// keep reading, so that the download and the extraction are not blocked
+					io.Copy(ioutil.Discard, saveFileR)
+				}
+				if err := out.Close(); err != nil && saveErr == nil {
+					saveErr = err
+				}
 				Debugf(funcName + "(): Finished creating " + targetFileName)
 			}()
 			wgForgeModule.Add(1)
-			go extractForgeModule(&wgForgeModule, extractR, fileName)
+			go extractForgeModule(&wgForgeModule, extractR, fileName, tempDir)
 			wgForgeModule.Add(1)
 			go func() {
 				defer wgForgeModule.Done()
@@ -416,13 +458,15 @@ func downloadForgeModule(name string, version string, fm ForgeModule, retryCount
 				defer extractW.Close()
 				defer saveFileW.Close()
 
-				// build the multiwriter for all the pipes
-				mw := io.MultiWriter(extractW, saveFileW)
+				// build the multiwriter for all the pipes and hash the archive while downloading it
+				mw := io.MultiWriter(extractW, saveFileW, hashSha256)
 
 				// copy the data into the multiwriter
-				if _, err := io.Copy(mw, resp.Body); err != nil {
+				n, err := io.Copy(mw, resp.Body)
+				if err != nil {
 					Fatalf("Error while writing to MultiWriter " + err.Error())
 				}
+				calculatedArchiveSize = n
 			}()
 		} else if resp.StatusCode == http.StatusNotFound {
 			Fatalf("Received 404 from Forge using URL " + url +
@@ -435,23 +479,105 @@ func downloadForgeModule(name string, version string, fm ForgeModule, retryCount
 		Debugf("Using cache for Forge module " + name + " version: " + version)
 	}
 	wgForgeModule.Wait()
+	// release the host before a retry takes it again
+	releaseHost()
 
-	if checkSum || fm.sha256sum != "" {
-		fm.version = version
-		if doForgeModuleIntegrityCheck(fm) {
+	if downloaded {
+		if saveErr != nil {
+			Warnf("WARNING: Error while writing Forge module archive " + filepath.Join(tempDir, fileName) + " Error: " + saveErr.Error())
+		}
+		if saveErr != nil || !verifyForgeModuleArchive(fm, version, fr, hex.EncodeToString(hashSha256.Sum(nil)), calculatedArchiveSize) {
+			quarantineForgeModule(fm, tempDir, name, version)
+			removeTempDir(tempDir)
 			if retryCount == 0 {
 				Fatalf("downloadForgeModule(): giving up for Puppet module " + name + " version: " + version)
 			}
 			Warnf("Retrying...")
-			purgeDir(filepath.Join(config.ForgeCacheDir, fileName), "downloadForgeModule()")
-			purgeDir(strings.Replace(filepath.Join(config.ForgeCacheDir, fileName), ".tar.gz", "/", -1), "downloadForgeModule()")
 			// retry if hash sum mismatch found
-			downloadForgeModule(name, version, fm, retryCount-1)
+			downloadForgeModule(name, version, fm, fr, retryCount-1)
+			return
+		}
+		if !isDir(filepath.Join(tempDir, name+"-"+version)) {
+			removeTempDir(tempDir)
+			Fatalf(funcName + "(): Forge module archive " + fileName + " does not contain the module directory " + name + "-" + version)
 		}
+		renameIntoPlace(filepath.Join(tempDir, fileName), filepath.Join(forgeCacheDir(fm), fileName))
+		renameIntoPlace(filepath.Join(tempDir, name+"-"+version), moduleDir)
+		removeTempDir(tempDir)
 	}
 
 }
 
+// verifyForgeModuleArchive compares the calculated sha256 sum and file size of the downloaded Forge module archive with the
+// sha256sum from the Puppetfile or the Forge API release metadata
+func verifyForgeModuleArchive(fm ForgeModule, version string, fr ForgeResult, calculatedSha256Sum string, calculatedArchiveSize int64) bool {
+	fileName := filepath.Join(forgeCacheDir(fm), fm.author+"-"+fm.name+"-"+version+".tar.gz")
+	if fr.versionNumber != version {
+		fr = ForgeResult{versionNumber: version}
+	}
+	if !fr.releaseQueried && len(fm.sha256sum) == 0 {
+		// only query the release metadata if it was not fetched before and the Puppetfile does not pin a sha256sum
+		fr = lookupForgeRelease(fm, version)
+	}
+	expectedSha256Sum := fr.sha256sum
+	if len(fm.sha256sum) > 0 {
+		Debugf("Using sha256sum " + fm.sha256sum + " from Puppetfile for " + fileName)
+		expectedSha256Sum = fm.sha256sum
+	}
+	if len(expectedSha256Sum) == 0 && fr.fileSize == 0 {
+		Warnf("WARN: Could not verify " + fileName + ", because neither the Puppetfile nor the Forge release metadata contain a sha256sum or file size")
+	} else if len(expectedSha256Sum) == 0 {
+		Warnf("WARN: Forge API did not return a sha256sum for " + fileName + ", only verifying the file size")
+	} else if calculatedSha256Sum != expectedSha256Sum {
+		Warnf("WARNING: calculated sha256sum " + calculatedSha256Sum + " for " + fileName + " does not match expected sha256sum " + expectedSha256Sum)
+		return false
+	}
+	if fr.fileSize > 0 && fr.fileSize != calculatedArchiveSize {
+		Warnf("WARNING: calculated file size " + strconv.FormatInt(calculatedArchiveSize, 10) + " for " + fileName + " does not match expected file size " + strconv.FormatInt(fr.fileSize, 10))
+		return false
+	}
+	Debugf("calculated sha256sum " + calculatedSha256Sum + " and file size " + strconv.FormatInt(calculatedArchiveSize, 10) + " for " + fileName + " match the expected values")
+	return true
+}
+
+// lookupForgeRelease returns the sha256sum and the file size of the given Forge module version from the Forge release metadata,
+// Forge mirrors that only serve the module archives only get a warning, because the archive can then only be verified with the
+// sha256sum from the Puppetfile
+func lookupForgeRelease(fm ForgeModule, version string) ForgeResult {
+	fm.version = version
+	fr := ForgeResult{versionNumber: version, releaseQueried: true}
+	fmm, err := queryForgeRelease(fm)
+	if err != nil {
+		Warnf("WARN: Could not get the release metadata of Forge module " + fm.author + "-" + fm.name + "-" + version + ", only verifying the sha256sum from the Puppetfile: " + err.Error())
+		return fr
+	}
+	fr.md5sum = fmm.md5sum
+	fr.sha256sum = fmm.sha256sum
+	fr.fileSize = fmm.fileSize
+	return fr
+}
+
+// quarantineForgeModule moves the Forge module archive and its extracted files from sourceDir out of the way into the quarantine directory of the Forge cache
+func quarantineForgeModule(fm ForgeModule, sourceDir string, name string, version string) {
+	quarantineBaseDir := checkDirAndCreate(filepath.Join(forgeCacheDir(fm), "quarantine"), "Forge cache quarantine dir")
+	// every failed download gets its own directory, so that retries do not overwrite each other
+	quarantineDir, err := ioutil.TempDir(quarantineBaseDir, name+"-"+version+"-"+time.Now().Format("20060102150405")+"-")
+	if err != nil {
+		Fatalf("quarantineForgeModule(): Error while creating quarantine directory in " + quarantineBaseDir + " Error: " + err.Error())
+	}
+	for _, file := range []string{name + "-" + version + ".tar.gz", name + "-" + version} {
+		source := filepath.Join(sourceDir, file)
+		if _, err := os.Lstat(source); err != nil {
+			continue
+		}
+		target := filepath.Join(quarantineDir, file)
+		Warnf("WARN: Moving " + source + " to quarantine " + target)
+		if err := os.Rename(source, target); err != nil {
+			Fatalf("quarantineForgeModule(): Error while moving " + source + " to " + target + " Error: " + err.Error())
+		}
+	}
+}
+
 // readModuleMetadata returns the Forgemodule struct of the given module file path
 func readModuleMetadata(file string) ForgeModule {
 	content, _ := ioutil.ReadFile(file)
@@ -460,6 +586,8 @@ func readModuleMetadata(file string) ForgeModule {
 	name := gjson.Get(string(content), "name").String()
 	version := gjson.Get(string(content), "version").String()
 	author := gjson.Get(string(content), "author").String()
+	license := gjson.Get(string(content), "license").String()
+	summary := gjson.Get(string(content), "summary").String()
 	duration := time.Since(before).Seconds()
 	mutex.Lock()
 	metadataJSONParseTime += duration
@@ -474,7 +602,7 @@ func readModuleMetadata(file string) ForgeModule {
 		Debugf("Error: Something went wrong while decoding file " + file + " searching for the module name (found for name: " + name + "), version and author")
 	}
 
-	return ForgeModule{name: moduleName, version: version, author: strings.ToLower(author)}
+	return ForgeModule{name: moduleName, version: version, author: strings.ToLower(author), license: license, summary: summary}
 }
 
 func resolveForgeModules(modules map[string]ForgeModule) {
@@ -487,14 +615,44 @@ func resolveForgeModules(modules map[string]ForgeModule) {
 	bar.PrependFunc(func(b *uiprogress.Bar) string {
 		return fmt.Sprintf("Resolving Forge modules (%d/%d)", b.Current(), len(modules))
 	})
+
+	// sources with their own maxworker setting get a dedicated worker pool, all other sources share the global one
+	pools := make(map[string]map[string]ForgeModule)
+	for m, fm := range modules {
+		pool := ""
+		if config.Sources[fm.source].Maxworker > 0 {
+			pool = fm.source
+		}
+		if _, ok := pools[pool]; !ok {
+			pools[pool] = make(map[string]ForgeModule)
+		}
+		pools[pool][m] = fm
+	}
+	var wgPools sync.WaitGroup
+	for pool, forgeModules := range pools {
+		maxworker := config.Maxworker
+		if len(pool) > 0 {
+			maxworker = config.Sources[pool].Maxworker
+		}
+		wgPools.Add(1)
+		go func(forgeModules map[string]ForgeModule, maxworker int) {
+			defer wgPools.Done()
+			resolveForgeModulePool(forgeModules, maxworker, bar)
+		}(forgeModules, maxworker)
+	}
+	wgPools.Wait()
+}
+
+// resolveForgeModulePool downloads the given Forge modules with at most maxworker concurrent workers
+func resolveForgeModulePool(modules map[string]ForgeModule, maxworker int, bar *uiprogress.Bar) {
 	// Dummy channel to coordinate the number of concurrent goroutines.
 	// This channel should be buffered otherwise we will be immediately blocked
 	// when trying to fill it.
 
-	Debugf("Resolving " + strconv.Itoa(len(modules)) + " Forge modules with " + strconv.Itoa(config.Maxworker) + " workers")
-	concurrentGoroutines := make(chan struct{}, config.Maxworker)
-	// Fill the dummy channel with config.Maxworker empty struct.
-	for i := 0; i < config.Maxworker; i++ {
+	Debugf("Resolving " + strconv.Itoa(len(modules)) + " Forge modules with " + strconv.Itoa(maxworker) + " workers")
+	concurrentGoroutines := make(chan struct{}, maxworker)
+	// Fill the dummy channel with maxworker empty struct.
+	for i := 0; i < maxworker; i++ {
 		concurrentGoroutines <- struct{}{}
 	}
 
@@ -546,127 +704,6 @@ func check4ForgeUpdate(moduleName string, currentVersion string, latestVersion s
 	}
 }
 
-func doForgeModuleIntegrityCheck(m ForgeModule) bool {
-	funcName := funcName()
-	var wgCheckSum sync.WaitGroup
-
-	wgCheckSum.Add(1)
-	fmm := ForgeModule{}
-	go func(m ForgeModule) {
-		defer wgCheckSum.Done()
-		fmm = getMetadataForgeModule(m)
-		Debugf(funcName + "(): target md5 hash sum: " + fmm.md5sum)
-		if m.sha256sum != "" {
-			Debugf(funcName + "(): target sha256 hash sum from Puppetfile: " + m.sha256sum)
-		}
-	}(m)
-
-	calculatedMd5Sum := ""
-	calculatedSha256Sum := ""
-	// http://rodaine.com/2015/04/async-split-io-reader-in-golang/
-	// create the pipes
-	md5R, md5W := io.Pipe()
-	sha256R, sha256W := io.Pipe()
-	var calculatedArchiveSize int64
-	fileName := filepath.Join(config.ForgeCacheDir, m.author+"-"+m.name+"-"+m.version+".tar.gz")
-
-	// md5 sum
-	wgCheckSum.Add(1)
-	go func(md5R *io.PipeReader) {
-		defer wgCheckSum.Done()
-		before := time.Now()
-		hashmd5 := md5.New()
-		if _, err := io.Copy(hashmd5, md5R); err != nil {
-			Fatalf(funcName + "(): Error while reading Forge module archive " + fileName + " ! Error: " + err.Error())
-		}
-		duration := time.Since(before).Seconds()
-		Verbosef("Calculating md5 sum for " + fileName + " took " + strconv.FormatFloat(duration, 'f', 5, 64) + "s")
-		calculatedMd5Sum = hex.EncodeToString(hashmd5.Sum(nil))
-		Debugf(funcName + "(): calculated md5 hash sum: " + calculatedMd5Sum)
-	}(md5R)
-
-	if m.sha256sum != "" {
-		// sha256 sum
-		wgCheckSum.Add(1)
-		go func(sha256R *io.PipeReader) {
-			defer wgCheckSum.Done()
-			before := time.Now()
-			hashSha256 := sha256.New()
-			if _, err := io.Copy(hashSha256, sha256R); err != nil {
-				Fatalf(funcName + "(): Error while reading Forge module archive " + fileName + " ! Error: " + err.Error())
-			}
-			duration := time.Since(before).Seconds()
-			Verbosef("Calculating sha256 sum for " + fileName + " took " + strconv.FormatFloat(duration, 'f', 5, 64) + "s")
-			calculatedSha256Sum = hex.EncodeToString(hashSha256.Sum(nil))
-			Debugf(funcName + "(): calculated sha256 hash sum: " + calculatedSha256Sum)
-		}(sha256R)
-	}
-
-	wgCheckSum.Add(1)
-	go func() {
-		defer wgCheckSum.Done()
-
-		// after completing the copy, we need to close
-		// the PipeWriters to propagate the EOF to all
-		// PipeReaders to avoid deadlock
-		defer md5W.Close()
-		if m.sha256sum != "" {
-			defer sha256W.Close()
-		}
-
-		var mw io.Writer
-		if m.sha256sum != "" {
-			// build the multiwriter for all the pipes
-			mw = io.MultiWriter(md5W, sha256W)
-		} else {
-			mw = io.MultiWriter(md5W)
-		}
-
-		before := time.Now()
-		if fi, err := os.Stat(fileName); err == nil {
-			calculatedArchiveSize = fi.Size()
-			file, err := os.Open(fileName)
-			if err != nil {
-				Fatalf("Can't access Forge module archive " + fileName + " ! Error: " + err.Error())
-			}
-			defer file.Close()
-
-			// copy the data into the multiwriter
-			if _, err := io.Copy(mw, file); err != nil {
-				Fatalf("Error while writing to MultiWriter " + err.Error())
-			}
-
-		} else {
-			Fatalf("Can't access Forge module archive " + fileName + " ! Error: " + err.Error())
-		}
-		duration := time.Since(before).Seconds()
-		Verbosef("Calculating hash sum(s) for " + fileName + " took " + strconv.FormatFloat(duration, 'f', 5, 64) + "s")
-		Debugf(funcName + "(): calculated archive size: " + strconv.FormatInt(calculatedArchiveSize, 10))
-	}()
-
-	wgCheckSum.Wait()
-
-	if fmm.md5sum != calculatedMd5Sum {
-		Warnf("WARNING: calculated md5sum " + calculatedMd5Sum + " for " + fileName + " does not match expected md5sum " + fmm.md5sum)
-		return true
-	}
-	if m.sha256sum != calculatedSha256Sum {
-		Warnf("WARNING: calculated sha256sum " + calculatedSha256Sum + " for " + fileName + " does not match expected sha256sum " + m.sha256sum)
-		return true
-	}
-	if fmm.fileSize != calculatedArchiveSize {
-		Warnf("WARNING: calculated file size " + strconv.FormatInt(calculatedArchiveSize, 10) + " for " + fileName + " does not match expected file size " + strconv.FormatInt(fmm.fileSize, 10))
-		return true
-	}
-	Debugf("calculated file size " + strconv.FormatInt(calculatedArchiveSize, 10) + " for " + fileName + " does match expected file size " + strconv.FormatInt(fmm.fileSize, 10))
-	Debugf("calculated md5sum " + calculatedMd5Sum + " for " + fileName + " does match expected md5sum " + fmm.md5sum)
-	if m.sha256sum != "" {
-		Debugf("calculated sha256sum " + calculatedSha256Sum + " for " + fileName + " does match expected sha256sum " + m.sha256sum)
-	}
-	return false
-
-}
-
 func syncForgeToModuleDir(name string, m ForgeModule, moduleDir string, correspondingPuppetEnvironment string) {
 	funcName := funcName()
 	mutex.Lock()
@@ -676,6 +713,7 @@ func syncForgeToModuleDir(name string, m ForgeModule, moduleDir string, correspo
 	//Debugf("m.name " + m.name + " m.version " + m.version + " moduleName " + moduleName)
 	targetDir := filepath.Join(moduleDir, m.name)
 	metadataFile := filepath.Join(targetDir, "metadata.json")
+	oldVersion := ""
 	if m.version == "present" {
 		if fileExists(metadataFile) {
 			Debugf("Nothing to do, found existing Forge module: " + targetDir)
@@ -713,6 +751,7 @@ func syncForgeToModuleDir(name string, m ForgeModule, moduleDir string, correspo
 				Debugf("Nothing to do, existing Forge module: " + targetDir + " has the same version " + me.version + " as the to be synced version: " + m.version)
 				return
 			}
+			oldVersion = me.version
 			Infof("Need to sync, because existing Forge module: " + targetDir + " has version " + me.version + " and the to be synced version is: " + m.version)
 			createOrPurgeDir(targetDir, "targetDir for module "+me.name)
 		} else {
@@ -720,7 +759,7 @@ func syncForgeToModuleDir(name string, m ForgeModule, moduleDir string, correspo
 			createOrPurgeDir(targetDir, "targetDir for module "+m.name+" with missing metadata.json")
 		}
 	}
-	workDir := normalizeDir(filepath.Join(config.ForgeCacheDir, moduleName+"-"+m.version))
+	workDir := normalizeDir(filepath.Join(forgeCacheDir(m), moduleName+"-"+m.version))
 	resolvedWorkDir, err := filepath.EvalSymlinks(workDir)
 	if err != nil {
 		Fatalf(funcName + "(): Failed to resolve possible symlink " + workDir + " Error: " + err.Error())
@@ -739,26 +778,26 @@ func syncForgeToModuleDir(name string, m ForgeModule, moduleDir string, correspo
 	}
 
 	Infof("Need to sync " + targetDir)
-	if !dryRun {
-		targetDir = checkDirAndCreate(targetDir, "as targetDir for module "+name)
-		var targetDirDevice, workDirDevice uint64
-		if fileInfo, err := os.Stat(targetDir); err == nil {
-			if fileInfo.Sys() != nil {
-				targetDirDevice = uint64(fileInfo.Sys().(*syscall.Stat_t).Dev)
-			}
-		} else {
-			Fatalf(funcName + "(): Error while os.Stat file " + targetDir)
+	if diffMode {
+		newVersion := m.version
+		if newVersion == "latest" {
+			latestForgeModules.RLock()
+			newVersion = latestForgeModules.m[moduleName]
+			latestForgeModules.RUnlock()
 		}
-		if fileInfo, err := os.Stat(resolvedWorkDir); err == nil {
-			if fileInfo.Sys() != nil {
-				workDirDevice = uint64(fileInfo.Sys().(*syscall.Stat_t).Dev)
-			}
-		} else {
-			Fatalf(funcName + "(): Error while os.Stat file " + resolvedWorkDir)
+		action := "update"
+		if len(oldVersion) == 0 {
+			action = "add"
 		}
-
-		if targetDirDevice != workDirDevice && !usemove {
-			Fatalf("Error: Can't hardlink Forge module files over different devices. Please consider changing the cachedir setting. ForgeCachedir: " + config.ForgeCacheDir + " target dir: " + targetDir)
+		recordModuleDiff(correspondingPuppetEnvironment, ModuleDiff{Name: m.name, Type: "forge", Action: action, OldVersion: oldVersion, NewVersion: newVersion})
+	}
+	if !dryRun {
+		targetDir = checkDirAndCreate(targetDir, "as targetDir for module "+name)
+		linkMode := config.LinkMode
+		if usemove {
+			linkMode = "move"
+		} else if (linkMode == "hardlink" || len(linkMode) == 0) && !sameDevice(targetDir, resolvedWorkDir) {
+			Fatalf("Error: Can't hardlink Forge module files over different devices. Please consider changing the cachedir setting or set link_mode to reflink, copy or auto. ForgeCachedir: " + forgeCacheDir(m) + " target dir: " + targetDir)
 		}
 
 		mutex.Lock()
@@ -768,47 +807,9 @@ func syncForgeToModuleDir(name string, m ForgeModule, moduleDir string, correspo
 		}
 		needSyncForgeCount++
 		mutex.Unlock()
-		destination := func(path string, info os.FileInfo, err error) error {
-			if err != nil {
-				Fatalf(funcName + "(): Error while calling generic func() Error " + err.Error())
-			}
-			target, err := filepath.Rel(resolvedWorkDir, path)
-			if err != nil {
-				Fatalf(funcName + "(): Can't make " + path + " relative to " + resolvedWorkDir + " Error: " + err.Error())
-			}
-
-			if info.IsDir() {
-				if target != "." { // skip the root dir
-					//Debugf(funcName + "() Trying to mkdir " + filepath.Join(targetDir, target))
-					err = os.Mkdir(filepath.Join(targetDir, target), os.FileMode(0755))
-					if err != nil {
-						Fatalf(funcName + "(): error while Mkdir() " + targetDir + "/" + target + " Error: " + err.Error())
-					}
-				}
-			} else {
-				if usemove {
-					//Debugf(funcName + "() Trying to helper.moveFile " + path + " to " + targetDir + target)
-					// deleteSourceFileToggle is set to false as we delete the source file later in the main() anyway after the sync completes
-					err = moveFile(path, filepath.Join(targetDir, target), false)
-					if err != nil {
-						Fatalf(funcName + "(): Failed to helper.moveFile " + path + " to " + targetDir + "/" + target + " Error: " + err.Error())
-					}
-				} else {
-					//Debugf(funcName + "() Trying to hardlink " + path + " to " + filepath.Join(targetDir, target))
-					err = os.Link(path, filepath.Join(targetDir, target))
-					if err != nil {
-						Fatalf(funcName + "(): Failed to hardlink " + path + " to " + targetDir + "/" + target + " Error: " + err.Error())
-					}
-				}
-			}
-			return nil
-		}
-
-		c := make(chan error)
 		Debugf(funcName + "() filepath.Walk'ing directory " + resolvedWorkDir)
 		before := time.Now()
-		go func() { c <- filepath.Walk(resolvedWorkDir, destination) }()
-		<-c // Walk done
+		linkCachedDir(resolvedWorkDir, targetDir, linkMode)
 		duration := time.Since(before).Seconds()
 		mutex.Lock()
 		ioForgeTime += duration
@@ -821,10 +822,10 @@ func syncForgeToModuleDir(name string, m ForgeModule, moduleDir string, correspo
 func getLatestCachedModule(m ForgeModule) string {
 	latest := "//"
 	version := "latest"
-	latestDir := filepath.Join(config.ForgeCacheDir, m.author+"-"+m.name+"-latest")
+	latestDir := filepath.Join(forgeCacheDir(m), m.author+"-"+m.name+"-latest")
 	if !isDir(latestDir) {
 
-		globPath := filepath.Join(config.ForgeCacheDir, m.author+"-"+m.name+"-*")
+		globPath := filepath.Join(forgeCacheDir(m), m.author+"-"+m.name+"-*")
 		Debugf("Glob'ing with path " + globPath)
 		matches, err := filepath.Glob(globPath)
 		if len(matches) == 0 {
@@ -861,7 +862,7 @@ func getLatestCachedModule(m ForgeModule) string {
 		}
 
 		version = strings.Split(versionDir, m.author+"-"+m.name+"-")[1]
-		latest = filepath.Join(config.ForgeCacheDir, m.author+"-"+m.name+"-"+version)
+		latest = filepath.Join(forgeCacheDir(m), m.author+"-"+m.name+"-"+version)
 	}
 
 	if latest == "//" {
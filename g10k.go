@@ -6,6 +6,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
 	"sync"
@@ -25,18 +26,32 @@ var (
 	pfLocation                   string
 	clonegit                     bool
 	dryRun                       bool
+	diffMode                     bool
+	diffFormat                   string
+	sbomFormat                   string
+	outdatedFormat               string
+	maintenanceMode              bool
+	updateMode                   bool
+	lintFormat                   string
+	fmtMode                      bool
+	updateLevel                  string
+	updateInclude                string
+	updateExclude                string
 	validate                     bool
 	check4update                 bool
 	checkSum                     bool
 	gitObjectSyntaxNotSupported  bool
 	moduleDirParam               string
 	cacheDirParam                string
+	linkModeParam                string
 	branchParam                  string
 	environmentParam             string
 	tags                         bool
 	outputNameParam              string
 	moduleParam                  string
 	configFile                   string
+	configDir                    string
+	configOrigins                map[string]string
 	config                       ConfigSettings
 	mutex                        sync.Mutex
 	empty                        struct{}
@@ -46,6 +61,7 @@ var (
 	needSyncForgeCount           int
 	needSyncDirs                 []string
 	needSyncEnvs                 map[string]struct{}
+	verifiedSigners              map[string]string
 	syncGitTime                  float64
 	syncForgeTime                float64
 	ioGitTime                    float64
@@ -59,6 +75,7 @@ var (
 	maxworker                    int
 	maxExtractworker             int
 	forgeModuleDeprecationNotice string
+	deployDiff                   DeployDiff
 )
 
 // LatestForgeModules contains a map of unique Forge modules
@@ -75,26 +92,31 @@ type ConfigSettings struct {
 	ModulesCacheDir             string
 	EnvCacheDir                 string
 	Git                         Git
+	Forge                       Forge  `yaml:"forge"`
+	Proxy                       string `yaml:"proxy"`
 	Sources                     map[string]Source
-	Timeout                     int            `yaml:"timeout"`
-	IgnoreUnreachableModules    bool           `yaml:"ignore_unreachable_modules"`
-	Maxworker                   int            `yaml:"maxworker"`
-	MaxExtractworker            int            `yaml:"maxextractworker"`
-	UseCacheFallback            bool           `yaml:"use_cache_fallback"`
-	RetryGitCommands            bool           `yaml:"retry_git_commands"`
-	GitObjectSyntaxNotSupported bool           `yaml:"git_object_syntax_not_supported"`
-	PostRunCommand              []string       `yaml:"postrun"`
-	Deploy                      DeploySettings `yaml:"deploy"`
-	PurgeLevels                 []string       `yaml:"purge_levels"`
-	PurgeAllowList              []string       `yaml:"purge_allowlist"`
-	DeploymentPurgeAllowList    []string       `yaml:"deployment_purge_allowlist"`
-	WriteLock                   string         `yaml:"write_lock"`
-	GenerateTypes               bool           `yaml:"generate_types"`
-	PuppetPath                  string         `yaml:"puppet_path"`
-	PurgeSkiplist               []string       `yaml:"purge_skiplist"`
-	CloneGitModules             bool           `yaml:"clone_git_modules"`
-	ForgeBaseURL                string         `yaml:"forge_base_url"`
-	ForgeCacheTTLString         string         `yaml:"forge_cache_ttl"`
+	Timeout                     int             `yaml:"timeout"`
+	Timeouts                    CommandTimeouts `yaml:"timeouts"`
+	IgnoreUnreachableModules    bool            `yaml:"ignore_unreachable_modules"`
+	Maxworker                   int             `yaml:"maxworker"`
+	MaxExtractworker            int             `yaml:"maxextractworker"`
+	UseCacheFallback            bool            `yaml:"use_cache_fallback"`
+	RetryGitCommands            bool            `yaml:"retry_git_commands"`
+	GitObjectSyntaxNotSupported bool            `yaml:"git_object_syntax_not_supported"`
+	PostRunCommand              []string        `yaml:"postrun"`
+	Deploy                      DeploySettings  `yaml:"deploy"`
+	PurgeLevels                 []string        `yaml:"purge_levels"`
+	PurgeAllowList              []string        `yaml:"purge_allowlist"`
+	DeploymentPurgeAllowList    []string        `yaml:"deployment_purge_allowlist"`
+	WriteLock                   string          `yaml:"write_lock"`
+	GenerateTypes               bool            `yaml:"generate_types"`
+	PuppetPath                  string          `yaml:"puppet_path"`
+	PurgeSkiplist               []string        `yaml:"purge_skiplist"`
+	CloneGitModules             bool            `yaml:"clone_git_modules"`
+	ErrorMissingLFSObject       bool            `yaml:"error_if_lfs_object_is_missing"`
+	ForgeBaseURL                string          `yaml:"forge_base_url"`
+	ForgeCacheTTLString         string          `yaml:"forge_cache_ttl"`
+	LinkMode                    string          `yaml:"link_mode"`
 	ForgeCacheTTL               time.Duration
 }
 
@@ -112,14 +134,46 @@ type DeploySettings struct {
 
 // Forge is a simple struct that contains the base URL of
 // the Forge that g10k should use. Defaults to: https://forgeapi.puppet.com
+// and the optional HTTP proxy for Forge API requests
 type Forge struct {
-	Baseurl string `yaml:"baseurl"`
+	Baseurl           string         `yaml:"baseurl"`
+	Proxy             string         `yaml:"proxy"`
+	HostLimits        map[string]int `yaml:"host_limits"`
+	RequestsPerSecond float64        `yaml:"requests_per_second"`
 }
 
-// Git is a simple struct that contains the optional SSH private key to
-// use for authentication
+// Git is a simple struct that contains the optional SSH private key,
+// the HTTPS credentials and the per repository SSH settings to use for authentication
 type Git struct {
-	privateKey string `yaml:"private_key"`
+	privateKey                string          `yaml:"private_key"`
+	Credentials               []GitCredential `yaml:"credentials"`
+	Repositories              []GitRepository `yaml:"repositories"`
+	GPGHome                   string          `yaml:"gpg_home"`
+	AllowedSignersFile        string          `yaml:"allowed_signers_file"`
+	Proxy                     string          `yaml:"proxy"`
+	LsRemoteCheck             bool            `yaml:"ls_remote_check"`
+	HostLimits                map[string]int  `yaml:"host_limits"`
+	RequestsPerSecond         float64         `yaml:"requests_per_second"`
+	MaintenanceIntervalString string          `yaml:"maintenance_interval"`
+	MaintenanceInterval       time.Duration
+}
+
+// GitRepository contains the SSH settings for all git remotes that match Remote, which is either the exact URL or a regular expression wrapped in slashes
+type GitRepository struct {
+	Remote         string `yaml:"remote"`
+	PrivateKey     string `yaml:"private_key"`
+	SSHUser        string `yaml:"ssh_user"`
+	KnownHostsFile string `yaml:"known_hosts_file"`
+	remoteRegexp   *regexp.Regexp
+}
+
+// GitCredential contains the HTTPS authentication for all git remotes whose host matches the Host pattern
+type GitCredential struct {
+	Host      string `yaml:"host"`
+	Username  string `yaml:"username"`
+	Token     string `yaml:"token"`
+	TokenFile string `yaml:"token_file"`
+	Helper    string `yaml:"helper"`
 }
 
 // Source contains basic information about a Puppet environment repository
@@ -127,15 +181,27 @@ type Source struct {
 	Remote                      string
 	Basedir                     string
 	Prefix                      string
-	PrivateKey                  string `yaml:"private_key"`
-	ForceForgeVersions          bool   `yaml:"force_forge_versions"`
-	WarnMissingBranch           bool   `yaml:"warn_if_branch_is_missing"`
-	ErrorMissingBranch          bool   `yaml:"error_if_branch_is_missing"`
-	ExitIfUnreachable           bool   `yaml:"exit_if_unreachable"`
-	AutoCorrectEnvironmentNames string `yaml:"invalid_branches"`
-	FilterCommand               string `yaml:"filter_command"`
-	FilterRegex                 string `yaml:"filter_regex"`
-	StripComponent              string `yaml:"strip_component"`
+	PrivateKey                  string          `yaml:"private_key"`
+	ForceForgeVersions          bool            `yaml:"force_forge_versions"`
+	WarnMissingBranch           bool            `yaml:"warn_if_branch_is_missing"`
+	ErrorMissingBranch          bool            `yaml:"error_if_branch_is_missing"`
+	ExitIfUnreachable           bool            `yaml:"exit_if_unreachable"`
+	AutoCorrectEnvironmentNames string          `yaml:"invalid_branches"`
+	FilterCommand               string          `yaml:"filter_command"`
+	FilterRegex                 string          `yaml:"filter_regex"`
+	StripComponent              string          `yaml:"strip_component"`
+	Timeout                     int             `yaml:"timeout"`
+	Timeouts                    CommandTimeouts `yaml:"timeouts"`
+	Maxworker                   int             `yaml:"maxworker"`
+	MaxExtractworker            int             `yaml:"maxextractworker"`
+	ForgeBaseURL                string          `yaml:"forge_base_url"`
+	CacheDir                    string          `yaml:"cachedir"`
+	MirrorMode                  string          `yaml:"mirror_mode"`
+	Submodules                  bool            `yaml:"submodules"`
+	VerifySignatures            bool            `yaml:"verify_signatures"`
+	ForgeCacheDir               string          `yaml:"-"`
+	ModulesCacheDir             string          `yaml:"-"`
+	EnvCacheDir                 string          `yaml:"-"`
 }
 
 // Puppetfile contains the key value pairs from the Puppetfile
@@ -152,6 +218,9 @@ type Puppetfile struct {
 	gitURL            string
 	moduleDirs        []string
 	controlRepoBranch string
+	timeout           int
+	forgeCacheDir     string
+	modulesCacheDir   string
 }
 
 // ForgeModule contains information (Version, Name, Author, md5 checksum, file size of the tar.gz archive, Forge BaseURL if custom) about a Puppetlabs Forge module
@@ -166,6 +235,10 @@ type ForgeModule struct {
 	sha256sum    string
 	moduleDir    string
 	sourceBranch string
+	source       string
+	cacheDir     string
+	license      string
+	summary      string
 }
 
 // GitModule contains information about a Git Puppet module
@@ -184,6 +257,13 @@ type GitModule struct {
 	local             bool
 	moduleDir         string
 	useSSHAgent       bool
+	source            string
+	cacheDir          string
+	timeout           int
+	mirrorMode        string
+	refs              []string
+	submodules        bool
+	verifySignatures  bool
 }
 
 // ForgeResult is returned by queryForgeAPI and contains if and which version of the Puppetlabs Forge module needs to be downloaded
@@ -192,29 +272,55 @@ type ForgeResult struct {
 	versionNumber string
 	md5sum        string
 	fileSize      int64
+	sha256sum     string
+	// releaseQueried is true if the checksums and the file size are from the Forge API
+	releaseQueried bool
+}
+
+// LFSPointer contains the Git LFS object of a pointer file that was extracted by unTar
+type LFSPointer struct {
+	oid     string
+	size    int64
+	file    string
+	mode    os.FileMode
+	modTime time.Time
 }
 
 // ExecResult contains the exit code and output of an external command (e.g. git)
 type ExecResult struct {
 	returnCode int
 	output     string
+	timedOut   bool
+}
+
+// CommandTimeouts contains the timeouts in seconds for git clone, fetch and archive commands and the postrun command
+type CommandTimeouts struct {
+	Clone       int `yaml:"clone"`
+	Fetch       int `yaml:"fetch"`
+	Archive     int `yaml:"archive"`
+	Postrun     int `yaml:"postrun"`
+	Maintenance int `yaml:"maintenance"`
 }
 
 // DeployResult contains information about the Puppet environment which was deployed by g10k and tries to emulate the .r10k-deploy.json
 type DeployResult struct {
-	Name               string    `json:"name"`
-	Signature          string    `json:"signature"`
-	StartedAt          time.Time `json:"started_at"`
-	FinishedAt         time.Time `json:"finished_at"`
-	DeploySuccess      bool      `json:"deploy_success"`
-	PuppetfileChecksum string    `json:"puppetfile_checksum"`
-	GitDir             string    `json:"git_dir"`
-	GitURL             string    `json:"git_url"`
+	Name               string                  `json:"name"`
+	Signature          string                  `json:"signature"`
+	StartedAt          time.Time               `json:"started_at"`
+	FinishedAt         time.Time               `json:"finished_at"`
+	DeploySuccess      bool                    `json:"deploy_success"`
+	PuppetfileChecksum string                  `json:"puppetfile_checksum"`
+	GitDir             string                  `json:"git_dir"`
+	GitURL             string                  `json:"git_url"`
+	Signer             string                  `json:"signer,omitempty"`
+	ModuleSigners      map[string]string       `json:"module_signers,omitempty"`
+	Fingerprint        *EnvironmentFingerprint `json:"fingerprint,omitempty"`
 }
 
 func init() {
 	// initialize global maps
 	needSyncEnvs = make(map[string]struct{})
+	verifiedSigners = make(map[string]string)
 	uniqueForgeModules = make(map[string]ForgeModule)
 }
 
@@ -224,6 +330,7 @@ func main() {
 		configFileFlag = flag.String("config", "", "which config file to use")
 		versionFlag    = flag.Bool("version", false, "show build time and version number")
 	)
+	flag.StringVar(&configDir, "configdir", "", "directory with additional config files (*.yaml, *.yml), which get merged in lexical order after the -config file")
 	flag.StringVar(&branchParam, "branch", "", "which git branch of the Puppet environment to update. Just the branch name, e.g. master, qa, dev")
 	flag.StringVar(&environmentParam, "environment", "", "which Puppet environment to update. Source name inside the config + '_' + branch name, e.g. foo_master, foo_qa, foo_dev")
 	flag.BoolVar(&tags, "tags", false, "to pull tags as well as branches")
@@ -231,6 +338,7 @@ func main() {
 	flag.StringVar(&moduleParam, "module", "", "which module of the Puppet environment to update, e.g. stdlib")
 	flag.StringVar(&moduleDirParam, "moduledir", "", "allows overriding of Puppetfile specific moduledir setting, the folder in which Puppet modules will be extracted")
 	flag.StringVar(&cacheDirParam, "cachedir", "", "allows overriding of the g10k config file cachedir setting, the folder in which g10k will download git repositories and Forge modules")
+	flag.StringVar(&linkModeParam, "linkmode", "", "allows overriding of the g10k config file link_mode setting, how g10k populates the Puppet environments from the Forge and git caches, either hardlink, reflink, copy or auto. Defaults to hardlink")
 	flag.IntVar(&maxworker, "maxworker", 50, "how many Goroutines are allowed to run in parallel for Git and Forge module resolving")
 	flag.IntVar(&maxExtractworker, "maxextractworker", 20, "how many Goroutines are allowed to run in parallel for local Git and Forge module extracting processes (git clone, untar and gunzip)")
 	flag.BoolVar(&pfMode, "puppetfile", false, "install all modules from Puppetfile in cwd")
@@ -238,10 +346,21 @@ func main() {
 	flag.BoolVar(&clonegit, "clonegit", false, "populate the Puppet environment with a git clone of each git Puppet module. Helpful when developing locally with -puppetfile")
 	flag.BoolVar(&force, "force", false, "purge the Puppet environment directory and do a full sync")
 	flag.BoolVar(&dryRun, "dryrun", false, "do not modify anything, just print what would be changed")
+	flag.BoolVar(&diffMode, "diff", false, "do not modify anything, just print a per environment plan of what would be changed. Does implicitly set dryrun to true")
+	flag.StringVar(&diffFormat, "diffformat", "text", "output format of the -diff plan, either text or json")
+	flag.StringVar(&lintFormat, "lint", "", "only lint the Puppetfile in -puppetfile mode and exit, exits with 1 if any errors or warnings were found. Output format is either text, json or sarif")
+	flag.BoolVar(&fmtMode, "fmt", false, "only format the Puppetfile in -puppetfile mode in place and exit. Use -dryrun to print the formatted Puppetfile instead")
+	flag.BoolVar(&updateMode, "update", false, "only bump the pinned Forge module versions and git module tags of the Puppetfile in -puppetfile mode in place and exit. Use -dryrun to only print the changes")
+	flag.StringVar(&updateLevel, "updatelevel", "major", "which updates -update is allowed to apply, either major, minor or patch")
+	flag.StringVar(&updateInclude, "updateinclude", "", "comma separated list of modules -update should update, e.g. puppetlabs/ntp,apache. Defaults to all modules")
+	flag.StringVar(&updateExclude, "updateexclude", "", "comma separated list of modules -update should not update, e.g. puppetlabs/ntp,apache")
+	flag.StringVar(&outdatedFormat, "outdated", "", "only print the Forge and git modules of the deployed Puppet environments for which newer versions are available and exit. Output format is either text, json or markdown. Use -environment or -branch to limit it to a single environment")
+	flag.StringVar(&sbomFormat, "sbom", "", "only print a SBOM of the deployed Puppet environments in the given format, either cyclonedx or spdx, and exit. Use -environment or -branch to limit it to a single environment")
+	flag.BoolVar(&maintenanceMode, "maintenance", false, "only run the maintenance of all cached git mirrors regardless of the maintenance_interval setting and exit. Runs git gc --auto, writes the commit-graphs and repairs corrupted mirrors")
 	flag.BoolVar(&validate, "validate", false, "only validate given configuration and exit")
 	flag.BoolVar(&usemove, "usemove", false, "do not use hardlinks to populate your Puppet environments with Puppetlabs Forge modules. Instead uses simple move commands and purges the Forge cache directory after each run! (Useful for g10k runs inside a Docker container)")
 	flag.BoolVar(&check4update, "check4update", false, "only check if the is newer version of the Puppet module avaialable. Does implicitly set dryrun to true")
-	flag.BoolVar(&checkSum, "checksum", false, "get the md5 check sum for each Puppetlabs Forge module and verify the integrity of the downloaded archive. Increases g10k run time!")
+	flag.BoolVar(&checkSum, "checksum", false, "deprecated: g10k always verifies the sha256 sum and file size of downloaded Puppetlabs Forge modules")
 	flag.BoolVar(&debug, "debug", false, "log debug output, defaults to false")
 	flag.BoolVar(&verbose, "verbose", false, "log verbose output, defaults to false")
 	flag.BoolVar(&info, "info", false, "log info output, defaults to false")
@@ -259,10 +378,16 @@ func main() {
 		os.Exit(0)
 	}
 
-	if check4update {
+	if check4update || diffMode {
 		dryRun = true
 	}
 
+	handleSignals()
+
+	if checkSum {
+		Warnf("WARN: The -checksum parameter is deprecated and has no effect, g10k always verifies the sha256 sum and file size of downloaded Forge modules")
+	}
+
 	// check for git executable dependency
 	if _, err := exec.LookPath("git"); err != nil {
 		Fatalf("Error: could not find 'git' executable in PATH")
@@ -270,7 +395,7 @@ func main() {
 
 	target := ""
 	before := time.Now()
-	if len(configFile) > 0 {
+	if len(configFile) > 0 || len(configDir) > 0 {
 		if usemove {
 			Fatalf("Error: -usemove parameter is only allowed in -puppetfile mode!")
 		}
@@ -286,7 +411,28 @@ func main() {
 		Debugf("Using as config file: " + configFile)
 		config = readConfigfile(configFile)
 		checkDirAndCreate(config.CacheDir, "cachedir configured value")
+		if len(sbomFormat) > 0 {
+			printSBOM(sbomFormat)
+			os.Exit(0)
+		}
+		if updateMode {
+			Fatalf("Error: -update parameter is only allowed in -puppetfile mode!")
+		}
+		if len(lintFormat) > 0 || fmtMode {
+			Fatalf("Error: -lint and -fmt parameters are only allowed in -puppetfile mode!")
+		}
+		if len(outdatedFormat) > 0 {
+			printOutdatedModules(outdatedFormat)
+			os.Exit(0)
+		}
+		if maintenanceMode {
+			maintainGitMirrors(true)
+			os.Exit(0)
+		}
 		target = configFile
+		if len(configFile) == 0 {
+			target = configDir
+		}
 		if len(branchParam) > 0 {
 			resolvePuppetEnvironment(tags, outputNameParam)
 			target += " with branch " + branchParam
@@ -294,7 +440,19 @@ func main() {
 			branchParam = ""
 			resolvePuppetEnvironment(tags, "")
 		}
+		if config.Git.MaintenanceInterval > 0 && !dryRun {
+			maintainGitMirrors(false)
+		}
 	} else {
+		if len(sbomFormat) > 0 {
+			Fatalf("Error: -sbom parameter is only allowed with -config parameter!")
+		}
+		if len(outdatedFormat) > 0 {
+			Fatalf("Error: -outdated parameter is only allowed with -config parameter!")
+		}
+		if maintenanceMode {
+			Fatalf("Error: -maintenance parameter is only allowed with -config parameter!")
+		}
 		if pfMode {
 			Debugf("Trying to use as Puppetfile: " + pfLocation)
 			sm := make(map[string]Source)
@@ -316,12 +474,27 @@ func main() {
 			config = ConfigSettings{CacheDir: cachedir, ForgeCacheDir: forgeCachedir, ModulesCacheDir: modulesCacheDir, EnvCacheDir: envsCacheDir, Sources: sm, ForgeBaseURL: "https://forgeapi.puppet.com", Maxworker: maxworker, UseCacheFallback: usecacheFallback, MaxExtractworker: maxExtractworker, RetryGitCommands: retryGitCommands, GitObjectSyntaxNotSupported: gitObjectSyntaxNotSupported}
 			// default purge_levels
 			config.PurgeLevels = []string{"puppetfile"}
+			setLinkMode()
 			if clonegit {
 				config.CloneGitModules = true
 			}
 			target = pfLocation
+			if len(lintFormat) > 0 {
+				if printLintFindings(target, lintFormat) {
+					os.Exit(1)
+				}
+				os.Exit(0)
+			}
+			if fmtMode {
+				formatPuppetfileInPlace(target)
+				os.Exit(0)
+			}
 			puppetfile := readPuppetfile(target, "", "cmdlineparam", "cmdlineparam", false, false)
 			puppetfile.workDir = ""
+			if updateMode {
+				updatePuppetfile(target, puppetfile, updateLevel)
+				os.Exit(0)
+			}
 			pfm := make(map[string]Puppetfile)
 			pfm["cmdlineparam"] = puppetfile
 			resolvePuppetfile(pfm)
@@ -338,6 +511,18 @@ func main() {
 	Debugf("Forge response JSON parsing took " + strconv.FormatFloat(forgeJSONParseTime, 'f', 4, 64) + " seconds")
 	Debugf("Forge modules metadata.json parsing took " + strconv.FormatFloat(metadataJSONParseTime, 'f', 4, 64) + " seconds")
 
+	if !dryRun {
+		pruneGitTreeCaches()
+	}
+
+	if diffMode {
+		printDeployDiff(diffFormat)
+		if deployDiffHasChanges() {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	if !check4update && !quiet {
 		if len(forgeModuleDeprecationNotice) > 0 {
 			Warnf(strings.TrimSuffix(forgeModuleDeprecationNotice, "\n"))
@@ -1,17 +1,25 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"runtime"
+	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/kballard/go-shellquote"
 	"github.com/xorpaul/uiprogress"
 )
 
@@ -25,14 +33,44 @@ func resolveGitRepositories(uniqueGitModules map[string]GitModule) {
 	bar.PrependFunc(func(b *uiprogress.Bar) string {
 		return fmt.Sprintf("Resolving Git modules (%d/%d)", b.Current(), len(uniqueGitModules))
 	})
+
+	// sources with their own maxworker setting get a dedicated worker pool, all other sources share the global one
+	pools := make(map[string]map[string]GitModule)
+	for workDir, gm := range uniqueGitModules {
+		pool := ""
+		if config.Sources[gm.source].Maxworker > 0 {
+			pool = gm.source
+		}
+		if _, ok := pools[pool]; !ok {
+			pools[pool] = make(map[string]GitModule)
+		}
+		pools[pool][workDir] = gm
+	}
+	var wgPools sync.WaitGroup
+	for pool, gitModules := range pools {
+		maxworker := config.Maxworker
+		if len(pool) > 0 {
+			maxworker = config.Sources[pool].Maxworker
+		}
+		wgPools.Add(1)
+		go func(gitModules map[string]GitModule, maxworker int) {
+			defer wgPools.Done()
+			resolveGitRepositoryPool(gitModules, maxworker, bar)
+		}(gitModules, maxworker)
+	}
+	wgPools.Wait()
+}
+
+// resolveGitRepositoryPool mirrors or updates the given git modules with at most maxworker concurrent workers
+func resolveGitRepositoryPool(gitModules map[string]GitModule, maxworker int, bar *uiprogress.Bar) {
 	// Dummy channel to coordinate the number of concurrent goroutines.
 	// This channel should be buffered otherwise we will be immediately blocked
 	// when trying to fill it.
 
-	Debugf("Resolving " + strconv.Itoa(len(uniqueGitModules)) + " Git modules with " + strconv.Itoa(config.Maxworker) + " workers")
-	concurrentGoroutines := make(chan struct{}, config.Maxworker)
-	// Fill the dummy channel with config.Maxworker empty struct.
-	for i := 0; i < config.Maxworker; i++ {
+	Debugf("Resolving " + strconv.Itoa(len(gitModules)) + " Git modules with " + strconv.Itoa(maxworker) + " workers")
+	concurrentGoroutines := make(chan struct{}, maxworker)
+	// Fill the dummy channel with maxworker empty struct.
+	for i := 0; i < maxworker; i++ {
 		concurrentGoroutines <- struct{}{}
 	}
 
@@ -44,7 +82,7 @@ func resolveGitRepositories(uniqueGitModules map[string]GitModule) {
 	// Collect all the jobs, and since the job is finished, we can
 	// release another spot for a goroutine.
 	go func() {
-		for _, gm := range uniqueGitModules {
+		for _, gm := range gitModules {
 			go func(gm GitModule) {
 				<-done
 				// Say that another goroutine can now start.
@@ -55,11 +93,11 @@ func resolveGitRepositories(uniqueGitModules map[string]GitModule) {
 		waitForAllJobs <- true
 	}()
 	wg := sync.WaitGroup{}
-	wg.Add(len(uniqueGitModules))
+	wg.Add(len(gitModules))
 
-	for url, gm := range uniqueGitModules {
+	for workDir, gm := range gitModules {
 		privateKey := gm.privateKey
-		go func(url string, gm GitModule, bar *uiprogress.Bar) {
+		go func(workDir string, gm GitModule, bar *uiprogress.Bar) {
 			// Try to receive from the concurrentGoroutines channel. When we have something,
 			// it means we can start a new goroutine because another one finished.
 			// Otherwise, it will block the execution until an execution
@@ -68,6 +106,7 @@ func resolveGitRepositories(uniqueGitModules map[string]GitModule) {
 			defer bar.Incr()
 			defer wg.Done()
 
+			url := gm.git
 			if gm.useSSHAgent {
 				Debugf("git repo url " + url + " with loaded SSH keys from ssh-agent")
 			} else if len(gm.privateKey) > 0 {
@@ -76,17 +115,12 @@ func resolveGitRepositories(uniqueGitModules map[string]GitModule) {
 				Debugf("git repo url " + url + " without ssh key")
 			}
 
-			//log.Println(config)
-			// create save directory name from Git repo name
-			repoDir := strings.Replace(strings.Replace(url, "/", "_", -1), ":", "-", -1)
-			workDir := filepath.Join(config.ModulesCacheDir, repoDir)
-
 			success := doMirrorOrUpdate(gm, workDir, 0)
 			if !success && !config.UseCacheFallback {
 				Fatalf("Fatal: Failed to clone or pull " + url + " to " + workDir)
 			}
 			done <- true
-		}(url, gm, bar)
+		}(workDir, gm, bar)
 	}
 
 	// Wait for all jobs to finish
@@ -96,21 +130,24 @@ func resolveGitRepositories(uniqueGitModules map[string]GitModule) {
 
 func doMirrorOrUpdate(gitModule GitModule, workDir string, retryCount int) bool {
 	//fmt.Printf("%+v\n", gitModule)
-	isControlRepo := strings.HasPrefix(workDir, config.EnvCacheDir)
-	isInModulesCacheDir := strings.HasPrefix(workDir, config.ModulesCacheDir)
-
-	explicitlyLoadSSHKey := true
-	if len(gitModule.privateKey) == 0 || strings.Contains(gitModule.git, "github.com") || gitModule.useSSHAgent || strings.HasPrefix(gitModule.git, "https://") {
-		if gitModule.useSSHAgent || len(gitModule.privateKey) == 0 {
-			explicitlyLoadSSHKey = false
-		} else if isControlRepo {
-			explicitlyLoadSSHKey = true
-		} else {
-			explicitlyLoadSSHKey = false
-		}
-	}
+	isControlRepo := isEnvCacheDir(workDir)
+	isInModulesCacheDir := isModulesCacheDir(workDir)
+	timeout := gitModuleTimeout(gitModule)
+
 	er := ExecResult{}
+	// control repositories always need all branches
+	mirrorMode := gitModule.mirrorMode
+	if len(mirrorMode) == 0 || isControlRepo || !isInModulesCacheDir {
+		mirrorMode = "full"
+	}
+	if isDir(workDir) && isInModulesCacheDir && gitMirrorMode(workDir) != mirrorMode {
+		purgeDir(workDir, "mirror_mode changed to "+mirrorMode)
+	}
 	gitCmd := "git clone --mirror " + gitModule.git + " " + workDir
+	if mirrorMode == "partial" {
+		// only fetch the blobs that are needed for the git archive command later
+		gitCmd = "git clone --mirror --filter=blob:none " + gitModule.git + " " + workDir
+	}
 	if config.CloneGitModules && !isControlRepo && !isInModulesCacheDir {
 		// only clone here, because we can't be sure if a branch is used or a commit hash or tag
 		// we switch to the defined reference later
@@ -121,6 +158,10 @@ func doMirrorOrUpdate(gitModule GitModule, workDir string, retryCount int) bool
 			purgeDir(workDir, "git remote url changed")
 		} else {
 			gitCmd = "git --git-dir " + workDir + " remote update --prune"
+			if config.Git.LsRemoteCheck && mirrorMode != "shallow" && (isControlRepo || isInModulesCacheDir) && gitMirrorUpToDate(gitModule, workDir) {
+				Debugf("Skipping fetch of " + gitModule.git + " into " + workDir + ", because the remote references did not change")
+				return true
+			}
 		}
 	}
 
@@ -130,14 +171,18 @@ func doMirrorOrUpdate(gitModule GitModule, workDir string, retryCount int) bool
 		disableHttpProxy = true
 	}
 
-	if explicitlyLoadSSHKey {
-		sshAddCmd := "ssh-add "
-		if runtime.GOOS == "darwin" {
-			sshAddCmd = "ssh-add -K "
-		}
-		er = executeCommand("ssh-agent bash -c '"+sshAddCmd+gitModule.privateKey+"; "+gitCmd+"'", "", config.Timeout, gitModule.ignoreUnreachable, disableHttpProxy)
+	if mirrorMode == "shallow" {
+		gitCmd = "git --git-dir " + workDir + " fetch --depth 1"
+		er = fetchShallowMirror(gitModule, workDir, gitModule.refs)
 	} else {
-		er = executeCommand(gitCmd, "", config.Timeout, gitModule.ignoreUnreachable, disableHttpProxy)
+		gitCmdTimeout := gitCommandTimeout(gitModule, "clone")
+		if isDir(workDir) {
+			gitCmdTimeout = gitCommandTimeout(gitModule, "fetch")
+		}
+		er = executeGitRemoteCommand(gitModule, gitCmd, "", gitCmdTimeout, gitModule.ignoreUnreachable)
+		if er.returnCode == 0 && mirrorMode == "partial" {
+			executeCommand("git --git-dir "+workDir+" config g10k.mirrormode partial", "", timeout, false, false)
+		}
 	}
 
 	if er.returnCode != 0 {
@@ -146,6 +191,11 @@ func doMirrorOrUpdate(gitModule GitModule, workDir string, retryCount int) bool
 			Warnf("WARN: Trying to use cache for " + gitModule.git + " git repository")
 			return false
 		} else if config.RetryGitCommands && retryCount > -1 {
+			if !er.timedOut && reGitCorruption.MatchString(er.output) && isDir(workDir) && repairGitMirror(gitModule, workDir) {
+				// an intact mirror does not get repaired again, so the next failure purges it
+				Warnf("WARN: git command failed: " + gitCmd + " retrying with the repaired git mirror " + workDir)
+				return doMirrorOrUpdate(gitModule, workDir, retryCount)
+			}
 			Warnf("WARN: git command failed: " + gitCmd + " deleting local cached repository and retrying...")
 			purgeDir(workDir, "doMirrorOrUpdate, because git command failed, retrying")
 			return doMirrorOrUpdate(gitModule, workDir, retryCount-1)
@@ -157,11 +207,19 @@ func doMirrorOrUpdate(gitModule GitModule, workDir string, retryCount int) bool
 	if config.CloneGitModules && !isControlRepo && !isInModulesCacheDir {
 		// if clone of git modules was specified, switch to the module and try to switch to the reference commit hash/tag/branch
 		gitCmd = "git checkout " + gitModule.tree
-		er = executeCommand(gitCmd, workDir, config.Timeout, gitModule.ignoreUnreachable, disableHttpProxy)
+		er = executeCommand(gitCmd, workDir, gitCommandTimeout(gitModule, "archive"), gitModule.ignoreUnreachable, disableHttpProxy)
 		if er.returnCode != 0 {
 			Warnf("WARN: git repository " + gitModule.git + " does not exist or is unreachable at this moment! Error: " + er.output)
 			return false
 		}
+		if gitModule.submodules {
+			gitCmd = "git submodule update --init --recursive"
+			er = executeGitRemoteCommand(gitModule, gitCmd, workDir, gitCommandTimeout(gitModule, "clone"), gitModule.ignoreUnreachable)
+			if er.returnCode != 0 {
+				Warnf("WARN: Failed to update the submodules of git repository " + gitModule.git + " Error: " + er.output)
+				return false
+			}
+		}
 	}
 
 	return true
@@ -184,12 +242,25 @@ func syncToModuleDir(gitModule GitModule, srcDir string, targetDir string, corre
 		revParseCmd = revParseCmd + "'"
 	}
 
-	isControlRepo := strings.HasPrefix(srcDir, config.EnvCacheDir)
+	isControlRepo := isEnvCacheDir(srcDir)
 
-	er := executeCommand(revParseCmd, "", config.Timeout, gitModule.ignoreUnreachable, false)
+	er := executeCommand(revParseCmd, "", gitModuleTimeout(gitModule), gitModule.ignoreUnreachable, false)
+	if er.returnCode != 0 && !isControlRepo && fetchMissingGitRef(gitModule, srcDir, gitModule.tree) {
+		// partial and shallow mirrors may not contain the requested reference yet
+		er = executeCommand(revParseCmd, "", gitModuleTimeout(gitModule), gitModule.ignoreUnreachable, false)
+	}
+	if !isControlRepo {
+		// remember the resolved floating references for the fingerprint of the Puppet environment
+		resolvedCommit := ""
+		if er.returnCode == 0 {
+			resolvedCommit = strings.TrimSuffix(er.output, "\n")
+		}
+		recordFloatingGitRef(gitModule, correspondingPuppetEnvironment, resolvedCommit)
+	}
 	hashFile := filepath.Join(targetDir, ".latest_commit")
 	deployFile := filepath.Join(targetDir, ".g10k-deploy.json")
 	needToSync := true
+	oldCommit := ""
 	if er.returnCode != 0 {
 		if gitModule.ignoreUnreachable {
 			Debugf("Failed to populate module " + targetDir + " but ignore-unreachable is set. Continuing...")
@@ -198,11 +269,24 @@ func syncToModuleDir(gitModule GitModule, srcDir string, targetDir string, corre
 		return false
 	}
 
+	signer := ""
+	if gitModule.verifySignatures {
+		// refuse unsigned or untrusted references before anything gets extracted
+		// verify the resolved object and not the reference name, which could point somewhere else by now
+		signer = verifyGitSignature(gitModule, srcDir, strings.TrimSuffix(er.output, "\n"))
+		if !isControlRepo {
+			mutex.Lock()
+			verifiedSigners[targetDir] = signer
+			mutex.Unlock()
+		}
+	}
+
 	if len(er.output) > 0 {
 		commitHash := strings.TrimSuffix(er.output, "\n")
-		if strings.HasPrefix(srcDir, config.EnvCacheDir) {
+		if isControlRepo {
 			if fileExists(deployFile) {
 				dr := readDeployResultFile(deployFile)
+				oldCommit = dr.Signature
 				if dr.Signature == strings.TrimSuffix(er.output, "\n") && dr.DeploySuccess {
 					needToSync = false
 				}
@@ -210,6 +294,7 @@ func syncToModuleDir(gitModule GitModule, srcDir string, targetDir string, corre
 		} else {
 			targetHashByte, _ := ioutil.ReadFile(hashFile)
 			targetHash := string(targetHashByte)
+			oldCommit = targetHash
 			Debugf("string content of " + hashFile + " is: " + targetHash)
 			if targetHash == commitHash {
 				needToSync = false
@@ -229,13 +314,38 @@ func syncToModuleDir(gitModule GitModule, srcDir string, targetDir string, corre
 		}
 		needSyncGitCount++
 		mutex.Unlock()
+		if diffMode {
+			recordGitDiff(srcDir, targetDir, oldCommit, strings.TrimSuffix(er.output, "\n"), isControlRepo, correspondingPuppetEnvironment)
+		}
+		if diffMode {
+			// -diff mode only records the plan and does not populate anything
+			return true
+		}
+		commitHash := strings.TrimSuffix(er.output, "\n")
+		writeDeployFile := func() {
+			Debugf("Writing to deploy file " + deployFile)
+			dr := DeployResult{
+				Name:      gitModule.tree,
+				Signature: commitHash,
+				StartedAt: startedAt,
+				Signer:    signer,
+			}
+			writeStructJSONFile(deployFile, dr)
+		}
+		if isControlRepo && !pfMode && len(oldCommit) > 0 && isDir(targetDir) && !gitModule.submodules {
+			// only write the changed files, so that the live environment never misses its manifests or hieradata
+			if updateControlRepo(gitModule, srcDir, oldCommit, commitHash, targetDir, deployFile) {
+				writeDeployFile()
+				return true
+			}
+		}
 		moduleDir := "modules"
 		purgeWholeEnvDir := true
 		// check if it is a control repo and already exists
 		if isControlRepo && isDir(targetDir) {
 			// then check if it contains a Puppetfile
 			gitShowCmd := "git --git-dir " + srcDir + " show " + gitModule.tree + ":Puppetfile"
-			executeResult := executeCommand(gitShowCmd, "", config.Timeout, true, false)
+			executeResult := executeCommand(gitShowCmd, "", gitModuleTimeout(gitModule), true, false)
 			Debugf("Executing " + gitShowCmd)
 			if executeResult.returnCode != 0 {
 				purgeWholeEnvDir = true
@@ -267,52 +377,50 @@ func syncToModuleDir(gitModule GitModule, srcDir string, targetDir string, corre
 			if pfMode {
 				purgeDir(targetDir, "git dir with changes in -puppetfile mode")
 			}
-			checkDirAndCreate(targetDir, "git dir")
-			gitArchiveArgs := []string{"--git-dir", srcDir, "archive", gitModule.tree}
-			cmd := exec.Command("git", gitArchiveArgs...)
-			Debugf("Executing git --git-dir " + srcDir + " archive " + gitModule.tree)
-			cmdOut, err := cmd.StdoutPipe()
-			if err != nil {
-				if !gitModule.ignoreUnreachable {
-					Infof("Failed to populate module " + targetDir + " but ignore-unreachable is set. Continuing...")
-				} else {
+			// git modules get extracted into a temporary directory, which is renamed into place including its .latest_commit once it is complete.
+			// The control repo keeps its module dir and is only marked as successfully deployed after all modules are synced
+			extractDir := targetDir
+			if isControlRepo {
+				checkDirAndCreate(targetDir, "git dir")
+			} else {
+				extractDir = createTempDir(targetDir)
+			}
+			treeCacheDir := gitTreeCacheDir(gitModule)
+			useTreeCache := !isControlRepo && len(treeCacheDir) > 0
+			if useTreeCache && (config.LinkMode == "hardlink" || len(config.LinkMode) == 0) {
+				// hardlinks only work if the tree cache is located on the same device as the environment
+				useTreeCache = sameDevice(checkDirAndCreate(treeCacheDir, "cachedir/trees"), filepath.Dir(targetDir))
+			}
+			if useTreeCache {
+				// every tree only gets extracted once and is hardlinked into all environments using it
+				treeDir, ok := extractCachedGitTree(gitModule, srcDir, commitHash, treeCacheDir)
+				if !ok {
+					removeTempDir(extractDir)
 					return false
 				}
-				Fatalf("syncToModuleDir(): Failed to execute command: git --git-dir " + srcDir + " archive " + gitModule.tree + " Error: " + err.Error())
-			}
-			cmd.Start()
-
-			before := time.Now()
-			unTar(cmdOut, targetDir)
-			duration := time.Since(before).Seconds()
-			mutex.Lock()
-			ioGitTime += duration
-			mutex.Unlock()
-
-			err = cmd.Wait()
-			if err != nil {
-				Fatalf("syncToModuleDir(): Failed to execute command: git --git-dir " + srcDir + " archive " + gitModule.tree + " Error: " + err.Error())
-				//"\nIf you are using GitLab please ensure that you've added your deploy key to your repository." +
-				//"\nThe Puppet environment which is using this unresolveable repository is " + correspondingPuppetEnvironment)
+				before := time.Now()
+				linkCachedDir(treeDir, extractDir, config.LinkMode)
+				duration := time.Since(before).Seconds()
+				mutex.Lock()
+				ioGitTime += duration
+				mutex.Unlock()
+				Verbosef("Populating " + targetDir + " from " + treeDir + " took " + strconv.FormatFloat(duration, 'f', 5, 64) + "s")
+			} else if !extractGitTree(gitModule, srcDir, commitHash, extractDir) {
+				if !isControlRepo {
+					removeTempDir(extractDir)
+				}
+				return false
 			}
 
-			Verbosef("syncToModuleDir(): Executing git --git-dir " + srcDir + " archive " + gitModule.tree + " took " + strconv.FormatFloat(duration, 'f', 5, 64) + "s")
-
-			commitHash := strings.TrimSuffix(er.output, "\n")
 			if isControlRepo {
-				Debugf("Writing to deploy file " + deployFile)
-				dr := DeployResult{
-					Name:      gitModule.tree,
-					Signature: commitHash,
-					StartedAt: startedAt,
-				}
-				writeStructJSONFile(deployFile, dr)
+				writeDeployFile()
 			} else {
 				Debugf("Writing hash " + commitHash + " from command " + revParseCmd + " to " + hashFile)
-				f, _ := os.Create(hashFile)
-				defer f.Close()
-				f.WriteString(commitHash)
-				f.Sync()
+				if err := ioutil.WriteFile(filepath.Join(extractDir, ".latest_commit"), []byte(commitHash), 0644); err != nil {
+					Fatalf("syncToModuleDir(): Error while writing " + hashFile + " Error: " + err.Error())
+				}
+				renameIntoPlace(extractDir, targetDir)
+				removeTempDir(extractDir)
 			}
 
 		} else if config.CloneGitModules {
@@ -322,9 +430,440 @@ func syncToModuleDir(gitModule GitModule, srcDir string, targetDir string, corre
 	return true
 }
 
+// updateControlRepo applies the changes between the deployed commit oldCommit and newCommit to the control repo in targetDir.
+// All changed files get extracted into a temporary directory first, then the deleted files are removed and the changed files
+// are renamed into place one by one. Files that are not part of the diff are left alone, so untracked files that were added
+// by hand are not removed. Returns false if the whole control repo needs to be extracted, because oldCommit is not available
+// anymore or the changed files could not be extracted
+func updateControlRepo(gitModule GitModule, srcDir string, oldCommit string, newCommit string, targetDir string, deployFile string) bool {
+	timeout := gitModuleTimeout(gitModule)
+	if executeCommand("git --git-dir "+srcDir+" cat-file -e "+oldCommit+"^{commit}", "", timeout, true, false).returnCode != 0 {
+		Infof("Deployed commit " + oldCommit + " of " + targetDir + " is not available in " + srcDir + " anymore, extracting the whole control repo")
+		return false
+	}
+	er := executeCommand("git --git-dir "+srcDir+" diff-tree -r -z --no-renames --name-status "+oldCommit+" "+newCommit, "", timeout, false, false)
+	changed := []string{}
+	deleted := []string{}
+	// -z separates the status and the path of every entry with NUL bytes
+	fields := strings.Split(strings.TrimSuffix(er.output, "\x00"), "\x00")
+	for i := 0; i+1 < len(fields); i += 2 {
+		status, path := fields[i], fields[i+1]
+		if matchSkiplistContent(path) {
+			continue
+		}
+		if status == "D" {
+			deleted = append(deleted, path)
+		} else {
+			changed = append(changed, path)
+		}
+	}
+
+	// extract all changed files before touching targetDir, so that a failed git archive leaves the deployed environment alone
+	tempDir := ""
+	if len(changed) > 0 {
+		tempDir = createTempDir(targetDir)
+		defer removeTempDir(tempDir)
+		// limit the number of paths per git archive command to stay below the maximum command line length
+		for i := 0; i < len(changed); i += 500 {
+			end := i + 500
+			if end > len(changed) {
+				end = len(changed)
+			}
+			if !extractGitArchive(gitModule, srcDir, newCommit, tempDir, changed[i:end]...) {
+				return false
+			}
+		}
+	}
+
+	// an interrupted update leaves no deploy file behind, so that the next run extracts the whole control repo
+	if err := os.Remove(deployFile); err != nil && !os.IsNotExist(err) {
+		Fatalf("updateControlRepo(): Error while removing deploy file " + deployFile + " Error: " + err.Error())
+	}
+	// deletions first, because a deleted file may be replaced by a directory with the same name
+	for _, path := range deleted {
+		target := filepath.Join(targetDir, path)
+		Debugf("Removing deleted file " + target)
+		if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+			Fatalf("updateControlRepo(): Error while removing " + target + " Error: " + err.Error())
+		}
+		for dir := filepath.Dir(target); dir != targetDir && strings.HasPrefix(dir, targetDir); dir = filepath.Dir(dir) {
+			// os.Remove only removes empty directories
+			if os.Remove(dir) != nil {
+				break
+			}
+		}
+	}
+	for _, path := range changed {
+		source := filepath.Join(tempDir, path)
+		if _, err := os.Lstat(source); err != nil {
+			// e.g. submodule gitlinks are not part of the archive
+			continue
+		}
+		target := filepath.Join(targetDir, path)
+		checkDirAndCreate(filepath.Dir(target), "control repo dir")
+		if fi, err := os.Lstat(target); err == nil && fi.IsDir() {
+			// a directory that got replaced by a file
+			purgeDir(target, "updateControlRepo()")
+		}
+		Debugf("Renaming changed file " + source + " to " + target)
+		if err := os.Rename(source, target); err != nil {
+			Fatalf("updateControlRepo(): Error while renaming " + source + " to " + target + " Error: " + err.Error())
+		}
+	}
+	Infof("Updated control repo " + targetDir + " from " + oldCommit + " to " + newCommit + " with " + strconv.Itoa(len(changed)) + " changed and " + strconv.Itoa(len(deleted)) + " deleted files")
+	return true
+}
+
+// extractGitTree extracts the given commit of the git repository srcDir including its submodules into targetDir
+func extractGitTree(gitModule GitModule, srcDir string, commit string, targetDir string) bool {
+	if !extractGitArchive(gitModule, srcDir, commit, targetDir) {
+		return false
+	}
+	return !gitModule.submodules || syncGitSubmodules(gitModule, srcDir, commit, targetDir)
+}
+
+// usedGitTrees contains the cached git trees that were used in this g10k run
+var usedGitTrees = struct {
+	sync.Mutex
+	m map[string]bool
+}{m: make(map[string]bool)}
+
+// resetUsedGitTrees forgets the cached git trees used by a previous g10k run
+func resetUsedGitTrees() {
+	usedGitTrees.Lock()
+	usedGitTrees.m = make(map[string]bool)
+	usedGitTrees.Unlock()
+}
+
+// gitTreeCacheDir returns the directory of the extracted git trees next to the modules cache directory of the given git module
+func gitTreeCacheDir(gitModule GitModule) string {
+	modulesCacheDir := config.ModulesCacheDir
+	if len(gitModule.cacheDir) > 0 {
+		modulesCacheDir = gitModule.cacheDir
+	}
+	if len(modulesCacheDir) == 0 {
+		return ""
+	}
+	return filepath.Join(filepath.Dir(modulesCacheDir), "trees")
+}
+
+// gitTreeCacheKey returns the name of the extracted tree of the given commit in the tree cache, which is the tree hash plus
+// the settings that change the extracted content
+func gitTreeCacheKey(gitModule GitModule, srcDir string, commit string) (string, bool) {
+	er := executeCommand("git --git-dir "+srcDir+" rev-parse --verify "+commit+"^{tree}", "", gitModuleTimeout(gitModule), true, false)
+	if er.returnCode != 0 {
+		return "", false
+	}
+	key := strings.TrimSpace(er.output)
+	if gitModule.submodules {
+		key += "-submodules"
+		if gitModule.verifySignatures {
+			// the submodule commits only get verified while extracting them
+			key += "-verified"
+		}
+	}
+	if len(config.PurgeSkiplist) > 0 {
+		sum := sha256.Sum256([]byte(strings.Join(config.PurgeSkiplist, "\n")))
+		key += "-skiplist-" + hex.EncodeToString(sum[:])[:12]
+	}
+	return key, true
+}
+
+// extractCachedGitTree returns the tree cache directory of the given commit and extracts the commit into it if it is not cached yet
+func extractCachedGitTree(gitModule GitModule, srcDir string, commit string, treeCacheDir string) (string, bool) {
+	key, ok := gitTreeCacheKey(gitModule, srcDir, commit)
+	if !ok {
+		Debugf("Could not resolve the tree of " + commit + " in " + srcDir + ", extracting it without the tree cache")
+		key = commit
+	}
+	treeDir := filepath.Join(treeCacheDir, key)
+	lockGitDir(treeDir)
+	defer unlockGitDir(treeDir)
+	usedGitTrees.Lock()
+	usedGitTrees.m[treeDir] = true
+	usedGitTrees.Unlock()
+	if isDir(treeDir) {
+		Debugf("Using cached tree " + treeDir + " for commit " + commit + " of " + gitModule.git)
+		return treeDir, true
+	}
+	tempDir := createTempDir(treeDir)
+	if !extractGitTree(gitModule, srcDir, commit, tempDir) {
+		removeTempDir(tempDir)
+		return "", false
+	}
+	renameIntoPlace(tempDir, treeDir)
+	removeTempDir(tempDir)
+	return treeDir, true
+}
+
+// gitTreeHardlinked checks if any file of the given cached git tree is still hardlinked into a deployed module directory
+func gitTreeHardlinked(treeDir string) bool {
+	errHardlinked := errors.New("hardlinked")
+	err := filepath.Walk(treeDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() && info.Sys() != nil && info.Sys().(*syscall.Stat_t).Nlink > 1 {
+			return errHardlinked
+		}
+		return nil
+	})
+	// keep the tree if it could not be inspected completely
+	return err != nil
+}
+
+// pruneGitTreeCaches removes the cached git trees that were neither used in this g10k run nor are still hardlinked into
+// a deployed module directory
+func pruneGitTreeCaches() {
+	treeCacheDirs := map[string]bool{gitTreeCacheDir(GitModule{}): true}
+	for _, sa := range config.Sources {
+		treeCacheDirs[gitTreeCacheDir(GitModule{cacheDir: resolveSourceSettings(sa).ModulesCacheDir})] = true
+	}
+	for treeCacheDir := range treeCacheDirs {
+		if len(treeCacheDir) == 0 || !isDir(treeCacheDir) {
+			continue
+		}
+		entries, err := ioutil.ReadDir(treeCacheDir)
+		if err != nil {
+			Warnf("WARNING: Could not read the git tree cache directory " + treeCacheDir + " Error: " + err.Error())
+			continue
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() || strings.HasPrefix(entry.Name(), tempPathPrefix) {
+				continue
+			}
+			treeDir := filepath.Join(treeCacheDir, entry.Name())
+			usedGitTrees.Lock()
+			used := usedGitTrees.m[treeDir]
+			usedGitTrees.Unlock()
+			if used {
+				continue
+			}
+			lockGitDir(treeDir)
+			if !gitTreeHardlinked(treeDir) {
+				Debugf("Removing unused cached git tree " + treeDir)
+				purgeDir(treeDir, "pruneGitTreeCaches()")
+			}
+			unlockGitDir(treeDir)
+		}
+	}
+}
+
+// extractGitArchive extracts the given tree of the git repository srcDir or only the given paths of it into targetDir
+func extractGitArchive(gitModule GitModule, srcDir string, tree string, targetDir string, paths ...string) bool {
+	gitArchiveArgs := []string{"--git-dir", srcDir, "archive", tree}
+	if len(paths) > 0 {
+		// the paths are file names and not patterns
+		gitArchiveArgs = append(append([]string{"--literal-pathspecs"}, gitArchiveArgs...), "--")
+		gitArchiveArgs = append(gitArchiveArgs, paths...)
+	}
+	cmd := exec.Command("git", gitArchiveArgs...)
+	// partial mirrors fetch the missing blobs from the remote during git archive
+	cmd.Env = append(os.Environ(), gitRemoteEnv(gitModule)...)
+	Debugf("Executing git --git-dir " + srcDir + " archive " + tree)
+	cmdOut, err := cmd.StdoutPipe()
+	if err != nil {
+		if !gitModule.ignoreUnreachable {
+			Infof("Failed to populate module " + targetDir + " but ignore-unreachable is set. Continuing...")
+		} else {
+			return false
+		}
+		Fatalf("extractGitArchive(): Failed to execute command: git --git-dir " + srcDir + " archive " + tree + " Error: " + err.Error())
+	}
+	timeout := gitCommandTimeout(gitModule, "archive")
+	var timedOut int32
+	stopTimer, err := startCommandWithTimeout(cmd, timeout, &timedOut)
+	if err != nil {
+		Fatalf("extractGitArchive(): Failed to execute command: git --git-dir " + srcDir + " archive " + tree + " Error: " + err.Error())
+	}
+
+	before := time.Now()
+	lfsPointers := unTar(cmdOut, targetDir)
+	duration := time.Since(before).Seconds()
+	mutex.Lock()
+	ioGitTime += duration
+	mutex.Unlock()
+
+	err = cmd.Wait()
+	stopTimer()
+	if err != nil && atomic.LoadInt32(&timedOut) == 1 {
+		Fatalf("extractGitArchive(): git --git-dir " + srcDir + " archive " + tree + " timed out after " + strconv.Itoa(timeout) + "s and was killed")
+	} else if err != nil {
+		Fatalf("extractGitArchive(): Failed to execute command: git --git-dir " + srcDir + " archive " + tree + " Error: " + err.Error())
+		//"\nIf you are using GitLab please ensure that you've added your deploy key to your repository." +
+		//"\nThe Puppet environment which is using this unresolveable repository is " + correspondingPuppetEnvironment)
+	}
+
+	Verbosef("extractGitArchive(): Executing git --git-dir " + srcDir + " archive " + tree + " took " + strconv.FormatFloat(duration, 'f', 5, 64) + "s")
+	if len(lfsPointers) > 0 {
+		materializeLFSObjects(gitModule, srcDir, tree, lfsPointers)
+	}
+	return true
+}
+
+// syncGitSubmodules extracts the submodules recorded in the given commit of srcDir into their subdirectories of targetDir
+func syncGitSubmodules(gitModule GitModule, srcDir string, commit string, targetDir string) bool {
+	timeout := gitModuleTimeout(gitModule)
+	er := executeCommand("git --git-dir "+srcDir+" config --blob "+commit+":.gitmodules --get-regexp '^submodule\\..*\\.url$'", "", timeout, true, false)
+	if er.returnCode != 0 {
+		Debugf("No submodules found in " + srcDir + " for commit " + commit)
+		return true
+	}
+	submoduleURLs := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(er.output), "\n") {
+		// submodule.<name>.url <url>
+		parts := strings.SplitN(line, " ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		name := strings.TrimSuffix(strings.TrimPrefix(parts[0], "submodule."), ".url")
+		pathEr := executeCommand("git --git-dir "+srcDir+" config --blob "+commit+":.gitmodules submodule."+name+".path", "", timeout, true, false)
+		if pathEr.returnCode != 0 {
+			Warnf("WARN: Submodule " + name + " in " + gitModule.git + " has no path configured in .gitmodules")
+			continue
+		}
+		submoduleURLs[strings.TrimSpace(pathEr.output)] = resolveSubmoduleURL(gitModule.git, strings.TrimSpace(parts[1]))
+	}
+
+	// the gitlinks contain the commits of the submodules that are recorded in the parent repository
+	er = executeCommand("git --git-dir "+srcDir+" ls-tree -r "+commit, "", timeout, false, false)
+	for _, line := range strings.Split(strings.TrimSpace(er.output), "\n") {
+		// 160000 commit <hash>\t<path>
+		fields := strings.SplitN(line, "\t", 2)
+		if len(fields) != 2 || !strings.HasPrefix(fields[0], "160000 commit ") {
+			continue
+		}
+		submoduleCommit := strings.TrimPrefix(fields[0], "160000 commit ")
+		submodulePath := fields[1]
+		submoduleURL, ok := submoduleURLs[submodulePath]
+		if !ok {
+			Warnf("WARN: Skipping submodule " + submodulePath + " of " + gitModule.git + ", because it is missing in .gitmodules")
+			continue
+		}
+
+		submodule := GitModule{
+			git:               submoduleURL,
+			privateKey:        gitModule.privateKey,
+			tree:              submoduleCommit,
+			ignoreUnreachable: gitModule.ignoreUnreachable,
+			useSSHAgent:       gitModule.useSSHAgent,
+			source:            gitModule.source,
+			cacheDir:          gitModule.cacheDir,
+			timeout:           gitModule.timeout,
+			mirrorMode:        gitModule.mirrorMode,
+			refs:              []string{submoduleCommit},
+			submodules:        true,
+			verifySignatures:  gitModule.verifySignatures,
+		}
+		workDir := gitModuleCacheDir(submodule)
+		lockGitDir(workDir)
+		// reuse the cached mirror if it already contains the recorded commit
+		er = executeCommand("git --git-dir "+workDir+" cat-file -e "+submoduleCommit+"^{commit}", "", timeout, true, false)
+		if er.returnCode != 0 {
+			Debugf("Mirroring submodule " + submoduleURL + " of " + gitModule.git + " to " + workDir)
+			if !doMirrorOrUpdate(submodule, workDir, 0) {
+				unlockGitDir(workDir)
+				if gitModule.ignoreUnreachable {
+					return false
+				}
+				Fatalf("Failed to mirror submodule " + submoduleURL + " of git repository " + gitModule.git)
+			}
+		}
+		unlockGitDir(workDir)
+		if submodule.verifySignatures {
+			// the signed commit of the parent repository only pins the submodule commits, which have to be signed as well
+			verifyGitSignature(submodule, workDir, submoduleCommit)
+		}
+
+		submoduleDir := filepath.Join(targetDir, submodulePath)
+		checkDirAndCreate(submoduleDir, "git submodule dir")
+		if !extractGitArchive(submodule, workDir, submoduleCommit, submoduleDir) {
+			return false
+		}
+		if !syncGitSubmodules(submodule, workDir, submoduleCommit, submoduleDir) {
+			return false
+		}
+	}
+	return true
+}
+
+// resolveSubmoduleURL returns the URL of a submodule, relative submodule URLs are resolved against the URL of the parent repository
+func resolveSubmoduleURL(parentURL string, submoduleURL string) string {
+	if !strings.HasPrefix(submoduleURL, "./") && !strings.HasPrefix(submoduleURL, "../") {
+		return submoduleURL
+	}
+	base := strings.TrimSuffix(parentURL, "/")
+	separator := "/"
+	for {
+		if strings.HasPrefix(submoduleURL, "./") {
+			submoduleURL = strings.TrimPrefix(submoduleURL, "./")
+		} else if strings.HasPrefix(submoduleURL, "../") {
+			submoduleURL = strings.TrimPrefix(submoduleURL, "../")
+			// also handle scp-like URLs like git@github.com:xorpaul/g10k.git
+			if i := strings.LastIndexAny(base, "/:"); i >= 0 {
+				separator = string(base[i])
+				base = base[:i]
+			}
+		} else {
+			break
+		}
+	}
+	return base + separator + submoduleURL
+}
+
+// verifyGitSignature verifies the GPG or SSH signature of the given commit or annotated tag object hash and returns the signer
+func verifyGitSignature(gitModule GitModule, srcDir string, object string) string {
+	timeout := gitModuleTimeout(gitModule)
+	verifyCmd := "verify-commit"
+	er := executeCommand("git --git-dir "+srcDir+" cat-file -t "+object, "", timeout, true, false)
+	if strings.TrimSpace(er.output) == "tag" {
+		verifyCmd = "verify-tag"
+	}
+	gitCmd := "git --git-dir " + srcDir
+	if len(config.Git.AllowedSignersFile) > 0 {
+		gitCmd += " -c gpg.ssh.allowedSignersFile=" + config.Git.AllowedSignersFile
+	}
+	gitCmd += " " + verifyCmd + " --raw " + object
+	env := []string{}
+	if len(config.Git.GPGHome) > 0 {
+		env = append(env, "GNUPGHOME="+config.Git.GPGHome)
+	}
+	// gpg may need to fetch keys or talk to a smartcard, so the local timeout of a few seconds is not enough
+	er = executeCommand(gitCmd, "", gitCommandTimeout(gitModule, "archive"), true, false, env...)
+	if er.returnCode != 0 {
+		Fatalf("Error: Refusing to deploy " + gitModule.tree + " of git repository " + gitModule.git + " " + srcDir + ", because " + object + " has no valid signature of a trusted key. Output of " + gitCmd + ": " + er.output)
+	}
+	signer := parseGitSignatureSigner(er.output)
+	Debugf("Verified signature of " + gitModule.tree + " (" + object + ") in " + srcDir + " signed by " + signer)
+	return signer
+}
+
+// parseGitSignatureSigner returns the signer from the --raw output of git verify-commit and git verify-tag
+func parseGitSignatureSigner(output string) string {
+	name := ""
+	fingerprint := ""
+	// SSH signatures: Good "git" signature for alice@example.com with ED25519 key SHA256:...
+	reSSHSigner := regexp.MustCompile(`Good "git" signature for (.+) with \S+ key (\S+)`)
+	for _, line := range strings.Split(output, "\n") {
+		if m := reSSHSigner.FindStringSubmatch(line); len(m) == 3 {
+			return m[1] + " " + m[2]
+		}
+		fields := strings.SplitN(strings.TrimPrefix(line, "[GNUPG:] "), " ", 3)
+		if len(fields) > 1 && fields[0] == "VALIDSIG" {
+			fingerprint = fields[1]
+		} else if len(fields) > 2 && fields[0] == "GOODSIG" {
+			name = fields[2]
+		}
+	}
+	if len(name) == 0 && len(fingerprint) == 0 {
+		return "unknown"
+	}
+	return strings.TrimSpace(name + " " + fingerprint)
+}
+
 func detectDefaultBranch(gitDir string) string {
 	remoteShowOriginCmd := "git ls-remote --symref " + gitDir
-	er := executeCommand(remoteShowOriginCmd, "", config.Timeout, false, false)
+	er := executeCommand(remoteShowOriginCmd, "", gitModuleTimeout(GitModule{}), false, false)
 	foundRefs := strings.Split(er.output, "\n")
 	if len(foundRefs) < 1 {
 		Fatalf("Unable to detect default branch for git repository with command git ls-remote --symref " + gitDir)
@@ -340,7 +879,7 @@ func detectDefaultBranch(gitDir string) string {
 func detectGitRemoteURLChange(d string, url string) bool {
 	gitRemoteCmd := "git --git-dir " + d + " remote -v"
 
-	er := executeCommand(gitRemoteCmd, "", config.Timeout, false, false)
+	er := executeCommand(gitRemoteCmd, "", gitModuleTimeout(GitModule{}), false, false)
 	if er.returnCode != 0 {
 		Warnf("WARN: Could not detect remote URL for git repository " + d + " trying to purge it and mirror it again")
 		return true
@@ -354,3 +893,401 @@ func detectGitRemoteURLChange(d string, url string) bool {
 	configuredRemote := f[1]
 	return configuredRemote != url
 }
+
+// gitURLHost returns the host name of the given git remote URL, which can either be a URL with a scheme or a scp-like SSH address
+func gitURLHost(gitURL string) string {
+	if strings.Contains(gitURL, "://") {
+		u, err := url.Parse(gitURL)
+		if err != nil {
+			return ""
+		}
+		return u.Hostname()
+	}
+	// scp-like syntax, e.g. git@github.com:xorpaul/g10k.git
+	host := gitURL
+	if i := strings.Index(host, "@"); i >= 0 {
+		host = host[i+1:]
+	}
+	if i := strings.Index(host, ":"); i >= 0 {
+		return host[:i]
+	}
+	return ""
+}
+
+// normalizeGitURL removes the user name and password from HTTP(S) git remote URLs, so that credentials do not end up in cache directory names
+func normalizeGitURL(gitURL string) string {
+	if !strings.HasPrefix(gitURL, "https://") && !strings.HasPrefix(gitURL, "http://") {
+		return gitURL
+	}
+	u, err := url.Parse(gitURL)
+	if err != nil || u.User == nil {
+		return gitURL
+	}
+	u.User = nil
+	return u.String()
+}
+
+var (
+	reFullCommitHash = regexp.MustCompile(`^[0-9a-f]{40}$`)
+	// reGitCorruption matches the git error messages of missing or broken objects, which are worth a repair of the mirror instead of cloning it again
+	reGitCorruption = regexp.MustCompile(`(?i)(bad object|missing (blob|tree|commit|object)|corrupt|did not send all necessary objects|unable to read|inflate|invalid object|broken link|packfile)`)
+	gitDirLocks     struct {
+		sync.Mutex
+		m map[string]*sync.Mutex
+	}
+	// lsRemoteCache contains the remote references of every git URL, so that each remote is only queried once per g10k run
+	lsRemoteCache struct {
+		sync.Mutex
+		m map[string]*LsRemoteResult
+	}
+)
+
+// LsRemoteResult contains the references and the default branch of a git remote
+type LsRemoteResult struct {
+	sync.Mutex
+	done          bool
+	refs          map[string]string
+	defaultBranch string
+}
+
+// resetLsRemoteCache forgets the remote references of the previous g10k run
+func resetLsRemoteCache() {
+	lsRemoteCache.Lock()
+	lsRemoteCache.m = make(map[string]*LsRemoteResult)
+	lsRemoteCache.Unlock()
+}
+
+// forgetLsRemote removes the cached remote references of the given git URL
+func forgetLsRemote(gitURL string) {
+	lsRemoteCache.Lock()
+	delete(lsRemoteCache.m, gitURL)
+	lsRemoteCache.Unlock()
+}
+
+// gitLsRemote returns the references of the remote of the given git module, successful results are cached per git URL
+func gitLsRemote(gitModule GitModule) (*LsRemoteResult, ExecResult) {
+	lsRemoteCache.Lock()
+	if lsRemoteCache.m == nil {
+		lsRemoteCache.m = make(map[string]*LsRemoteResult)
+	}
+	lr, ok := lsRemoteCache.m[gitModule.git]
+	if !ok {
+		lr = &LsRemoteResult{}
+		lsRemoteCache.m[gitModule.git] = lr
+	}
+	lsRemoteCache.Unlock()
+
+	// concurrent queries of the same URL wait for the first one
+	lr.Lock()
+	defer lr.Unlock()
+	if lr.done {
+		Debugf("Using cached remote references of " + gitModule.git)
+		return lr, ExecResult{}
+	}
+	er := executeGitRemoteCommand(gitModule, "git ls-remote --symref "+gitModule.git, "", gitCommandTimeout(gitModule, "fetch"), gitModule.ignoreUnreachable)
+	if er.returnCode != 0 {
+		return lr, er
+	}
+	lr.refs = make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(er.output), "\n") {
+		parts := strings.Split(line, "\t")
+		if len(parts) != 2 {
+			continue
+		}
+		if strings.HasPrefix(parts[0], "ref: ") && parts[1] == "HEAD" {
+			lr.defaultBranch = strings.TrimPrefix(parts[0], "ref: refs/heads/")
+			continue
+		}
+		lr.refs[parts[1]] = parts[0]
+	}
+	lr.done = true
+	return lr, er
+}
+
+// gitMirrorUpToDate compares the references of the remote with the references of the given mirror to check if a fetch would change anything
+func gitMirrorUpToDate(gitModule GitModule, workDir string) bool {
+	lr, er := gitLsRemote(gitModule)
+	if er.returnCode != 0 {
+		Debugf("Could not list the remote references of " + gitModule.git + ", fetching it instead")
+		return false
+	}
+	remoteRefs := make(map[string]string)
+	for ref, object := range lr.refs {
+		// HEAD is not updated by fetches and peeled tags are no references of their own
+		if ref != "HEAD" && !strings.HasSuffix(ref, "^{}") {
+			remoteRefs[ref] = object
+		}
+	}
+	er = executeCommand("git --git-dir "+workDir+" for-each-ref --format='%(objectname) %(refname)'", "", gitModuleTimeout(gitModule), true, false)
+	if er.returnCode != 0 {
+		return false
+	}
+	localRefs := strings.Split(strings.TrimSpace(er.output), "\n")
+	if len(strings.TrimSpace(er.output)) == 0 {
+		localRefs = []string{}
+	}
+	if len(localRefs) != len(remoteRefs) {
+		Debugf("Need to fetch " + gitModule.git + ", because the mirror " + workDir + " contains " + strconv.Itoa(len(localRefs)) + " references and the remote " + strconv.Itoa(len(remoteRefs)))
+		return false
+	}
+	for _, line := range localRefs {
+		parts := strings.SplitN(line, " ", 2)
+		if len(parts) != 2 || remoteRefs[parts[1]] != parts[0] {
+			Debugf("Need to fetch " + gitModule.git + ", because reference " + line + " of the mirror " + workDir + " differs from the remote")
+			return false
+		}
+	}
+	return true
+}
+
+// executeGitRemoteCommand executes a git command that talks to the remote of the given git module within the limits of its git host
+func executeGitRemoteCommand(gitModule GitModule, command string, dir string, timeout int, allowFail bool) ExecResult {
+	releaseHost := acquireGitHost(gitModule.git)
+	defer releaseHost()
+	return executeCommand(command, dir, timeout, allowFail, matchGitRemoteURLNoProxy(gitModule.git), gitRemoteEnv(gitModule)...)
+}
+
+// gitRemoteEnv returns the environment variables for git commands that need to talk to the remote of the given git module
+func gitRemoteEnv(gitModule GitModule) []string {
+	env := append(gitCredentialEnv(gitModule.git), gitSSHEnv(gitModule)...)
+	return append(env, gitProxyEnv(gitModule.git)...)
+}
+
+// matchGitRepository returns the first git.repositories entry whose remote matches the given git URL
+func matchGitRepository(gitURL string) (GitRepository, bool) {
+	for _, repo := range config.Git.Repositories {
+		if repo.remoteRegexp != nil {
+			// remote patterns wrapped in slashes are regular expressions, like with strip_component
+			if repo.remoteRegexp.MatchString(gitURL) {
+				return repo, true
+			}
+		} else if repo.Remote == gitURL {
+			return repo, true
+		}
+	}
+	return GitRepository{}, false
+}
+
+// gitSSHEnv returns the GIT_SSH_COMMAND environment variable with the SSH key, user and known_hosts file for the given git module
+func gitSSHEnv(gitModule GitModule) []string {
+	// the private_key of the source is used for all git remotes, that are not matched by a git.repositories entry
+	privateKey := gitModule.privateKey
+	sshUser := ""
+	knownHostsFile := ""
+	if repo, ok := matchGitRepository(gitModule.git); ok {
+		privateKey = repo.PrivateKey
+		sshUser = repo.SSHUser
+		knownHostsFile = repo.KnownHostsFile
+	}
+	if gitModule.useSSHAgent {
+		// use the keys that are already loaded in the ssh-agent
+		privateKey = ""
+	}
+	if len(privateKey) == 0 && len(sshUser) == 0 && len(knownHostsFile) == 0 {
+		return nil
+	}
+
+	sshCmd := []string{"ssh"}
+	if len(privateKey) > 0 {
+		sshCmd = append(sshCmd, "-i", privateKey, "-o", "IdentitiesOnly=yes")
+	}
+	if len(sshUser) > 0 {
+		sshCmd = append(sshCmd, "-l", sshUser)
+	}
+	if len(knownHostsFile) > 0 {
+		sshCmd = append(sshCmd, "-o", "UserKnownHostsFile="+knownHostsFile, "-o", "StrictHostKeyChecking=yes")
+	}
+	Debugf("Using GIT_SSH_COMMAND " + shellquote.Join(sshCmd...) + " for " + gitModule.git)
+	return []string{"GIT_SSH_COMMAND=" + shellquote.Join(sshCmd...)}
+}
+
+// gitCredentialEnv returns the environment variables that make git authenticate with the first matching git.credentials entry for the given HTTP(S) remote URL
+func gitCredentialEnv(gitURL string) []string {
+	if !strings.HasPrefix(gitURL, "https://") && !strings.HasPrefix(gitURL, "http://") {
+		return nil
+	}
+	c, ok := matchGitCredential(gitURL)
+	if !ok {
+		return nil
+	}
+	key := "http.extraHeader"
+	value := ""
+	if len(c.Helper) > 0 {
+		key = "credential.helper"
+		value = c.Helper
+	} else {
+		value = "Authorization: " + gitCredentialAuthorization(c)
+	}
+	// append to the git config entries of the environment g10k was started with instead of replacing them
+	index := 0
+	if count, err := strconv.Atoi(os.Getenv("GIT_CONFIG_COUNT")); err == nil && count > 0 {
+		index = count
+	}
+	// never let git ask for a password on the terminal, which would block g10k
+	return []string{"GIT_TERMINAL_PROMPT=0", "GIT_CONFIG_COUNT=" + strconv.Itoa(index+1),
+		"GIT_CONFIG_KEY_" + strconv.Itoa(index) + "=" + key, "GIT_CONFIG_VALUE_" + strconv.Itoa(index) + "=" + value}
+}
+
+// matchGitCredential returns the first git.credentials entry whose host pattern matches the host of the given URL
+func matchGitCredential(gitURL string) (GitCredential, bool) {
+	host := gitURLHost(gitURL)
+	for _, c := range config.Git.Credentials {
+		if match, _ := filepath.Match(c.Host, host); match {
+			Debugf("Using git credential of host pattern " + c.Host + " for " + gitURL)
+			return c, true
+		}
+	}
+	return GitCredential{}, false
+}
+
+// gitCredentialAuthorization returns the value of the HTTP Basic Authorization header for the given git credential
+func gitCredentialAuthorization(c GitCredential) string {
+	auth := base64.StdEncoding.EncodeToString([]byte(c.Username + ":" + c.Token))
+	addSecret(auth)
+	return "Basic " + auth
+}
+
+// gitMirrorMode returns the mirror_mode that was used to create the given git repository mirror
+func gitMirrorMode(workDir string) string {
+	er := executeCommand("git --git-dir "+workDir+" config g10k.mirrormode", "", gitModuleTimeout(GitModule{}), true, false)
+	if er.returnCode != 0 {
+		// only partial and shallow mirrors have this setting
+		return "full"
+	}
+	return strings.TrimSpace(er.output)
+}
+
+// mergeMirrorModes returns the more complete of the two given mirror_mode settings
+func mergeMirrorModes(a string, b string) string {
+	rank := map[string]int{"shallow": 0, "partial": 1, "full": 2, "": 2}
+	if rank[b] > rank[a] {
+		return b
+	}
+	return a
+}
+
+// gitModuleRefs returns the git references of the given git module that a shallow mirror needs to contain
+func gitModuleRefs(gm GitModule, pf Puppetfile) []string {
+	refs := []string{}
+	for _, ref := range []string{gm.branch, gm.tag, gm.commit, gm.ref} {
+		if len(ref) > 0 {
+			refs = append(refs, ref)
+		}
+	}
+	if gm.link {
+		if len(pf.controlRepoBranch) > 0 {
+			refs = append(refs, pf.controlRepoBranch)
+		} else if len(os.Getenv("g10k_branch")) > 0 {
+			refs = append(refs, os.Getenv("g10k_branch"))
+		} else if len(branchParam) > 0 {
+			refs = append(refs, branchParam)
+		}
+	}
+	refs = append(refs, gm.fallback...)
+	if len(refs) == 0 {
+		refs = append(refs, "HEAD")
+	}
+	return refs
+}
+
+// fetchShallowMirror creates or updates a shallow mirror, that only contains the latest commit of the given references
+func fetchShallowMirror(gitModule GitModule, workDir string, refs []string) ExecResult {
+	timeout := gitModuleTimeout(gitModule)
+	if !isDir(workDir) {
+		for _, gitCmd := range []string{
+			"git init --bare --quiet " + workDir,
+			"git --git-dir " + workDir + " remote add --mirror=fetch origin " + gitModule.git,
+			"git --git-dir " + workDir + " config g10k.mirrormode shallow",
+		} {
+			if er := executeCommand(gitCmd, "", timeout, gitModule.ignoreUnreachable, false); er.returnCode != 0 {
+				return er
+			}
+		}
+	}
+
+	lr, er := gitLsRemote(gitModule)
+	if er.returnCode != 0 {
+		return er
+	}
+	remoteRefs := lr.refs
+	defaultBranch := lr.defaultBranch
+
+	refspecs := []string{}
+	for _, ref := range refs {
+		if ref == "HEAD" {
+			ref = defaultBranch
+		}
+		if _, ok := remoteRefs["refs/heads/"+ref]; ok {
+			refspecs = append(refspecs, "+refs/heads/"+ref+":refs/heads/"+ref)
+		} else if _, ok := remoteRefs["refs/tags/"+ref]; ok {
+			refspecs = append(refspecs, "+refs/tags/"+ref+":refs/tags/"+ref)
+		} else if _, ok := remoteRefs[ref]; ok && strings.HasPrefix(ref, "refs/") {
+			refspecs = append(refspecs, "+"+ref+":"+ref)
+		} else if reFullCommitHash.MatchString(ref) {
+			// commits can only be fetched with their full hash
+			refspecs = append(refspecs, ref)
+		} else {
+			Debugf("Could not find reference " + ref + " in git repository " + gitModule.git)
+		}
+	}
+
+	// remove references that do not exist on the remote anymore, like remote update --prune does for full mirrors
+	er = executeCommand("git --git-dir "+workDir+" for-each-ref --format=%(refname) refs/heads refs/tags", "", timeout, true, false)
+	for _, localRef := range strings.Fields(er.output) {
+		if _, ok := remoteRefs[localRef]; !ok {
+			executeCommand("git --git-dir "+workDir+" update-ref -d "+localRef, "", timeout, true, false)
+		}
+	}
+
+	if len(refspecs) > 0 {
+		er = executeGitRemoteCommand(gitModule, "git --git-dir "+workDir+" fetch --quiet --depth 1 --force origin "+strings.Join(refspecs, " "), "", gitCommandTimeout(gitModule, "fetch"), gitModule.ignoreUnreachable)
+		if er.returnCode != 0 {
+			return er
+		}
+	}
+	if len(defaultBranch) > 0 {
+		// detectDefaultBranch() uses the HEAD of the mirror
+		executeCommand("git --git-dir "+workDir+" symbolic-ref HEAD refs/heads/"+defaultBranch, "", timeout, true, false)
+	}
+	return ExecResult{}
+}
+
+// fetchMissingGitRef fetches the given reference into a partial or shallow mirror, which does not contain it yet, and returns true if the mirror was updated
+func fetchMissingGitRef(gitModule GitModule, workDir string, ref string) bool {
+	mirrorMode := gitMirrorMode(workDir)
+	if mirrorMode == "full" {
+		return false
+	}
+	lockGitDir(workDir)
+	defer unlockGitDir(workDir)
+	Debugf("Trying to fetch missing reference " + ref + " into " + mirrorMode + " mirror " + workDir)
+	if mirrorMode == "shallow" {
+		// the reference may have been created after the remote references got cached
+		forgetLsRemote(gitModule.git)
+		return fetchShallowMirror(gitModule, workDir, []string{ref}).returnCode == 0
+	}
+	er := executeGitRemoteCommand(gitModule, "git --git-dir "+workDir+" remote update --prune", "", gitCommandTimeout(gitModule, "fetch"), true)
+	return er.returnCode == 0
+}
+
+// lockGitDir serializes fetches into the same git repository mirror
+func lockGitDir(workDir string) {
+	gitDirLocks.Lock()
+	if gitDirLocks.m == nil {
+		gitDirLocks.m = make(map[string]*sync.Mutex)
+	}
+	if _, ok := gitDirLocks.m[workDir]; !ok {
+		gitDirLocks.m[workDir] = &sync.Mutex{}
+	}
+	m := gitDirLocks.m[workDir]
+	gitDirLocks.Unlock()
+	m.Lock()
+}
+
+// unlockGitDir releases the lock of lockGitDir()
+func unlockGitDir(workDir string) {
+	gitDirLocks.Lock()
+	m := gitDirLocks.m[workDir]
+	gitDirLocks.Unlock()
+	m.Unlock()
+}
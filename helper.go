@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
@@ -8,12 +9,18 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -24,9 +31,50 @@ import (
 
 var validationMessages []string
 
+var reURLPassword = regexp.MustCompile(`(://[^/:@\s]+:)[^/@\s]+@`)
+
+// secrets contains all values that were interpolated into the g10k config and must not show up in any output
+var secrets struct {
+	sync.RWMutex
+	values []string
+}
+
+// minSecretLength is the minimal length of a registered secret, shorter values would redact unrelated parts of the log output
+const minSecretLength = 6
+
+// addSecret registers the given value to be redacted from all log output
+func addSecret(secret string) {
+	if len(secret) < minSecretLength {
+		return
+	}
+	secrets.Lock()
+	defer secrets.Unlock()
+	for _, s := range secrets.values {
+		if s == secret {
+			return
+		}
+	}
+	secrets.values = append(secrets.values, secret)
+	// replace longer secrets first, so that a secret containing another one gets completely redacted
+	sort.Slice(secrets.values, func(i, j int) bool {
+		return len(secrets.values[i]) > len(secrets.values[j])
+	})
+}
+
+// redactSecrets replaces all registered secrets and passwords inside of URLs in the given string
+func redactSecrets(s string) string {
+	secrets.RLock()
+	defer secrets.RUnlock()
+	for _, secret := range secrets.values {
+		s = strings.Replace(s, secret, "********", -1)
+	}
+	return reURLPassword.ReplaceAllString(s, "${1}********@")
+}
+
 // Debugf is a helper function for debug logging if global variable debug is set to true
 func Debugf(s string) {
 	if debug {
+		s = redactSecrets(s)
 		pc, _, _, _ := runtime.Caller(1)
 		callingFunctionName := strings.Split(runtime.FuncForPC(pc).Name(), ".")[len(strings.Split(runtime.FuncForPC(pc).Name(), "."))-1]
 		if strings.HasPrefix(callingFunctionName, "func") {
@@ -41,15 +89,28 @@ func Debugf(s string) {
 // Verbosef is a helper function for verbose logging if global variable verbose is set to true
 func Verbosef(s string) {
 	if debug || verbose {
-		log.Print(fmt.Sprint(s))
+		log.Print(fmt.Sprint(redactSecrets(s)))
 	}
 }
 
 // Infof is a helper function for info logging if global variable info is set to true
 func Infof(s string) {
 	if debug || verbose || info {
-		color.Green(s)
+		color.New(color.FgGreen).Fprintln(logOutput(), redactSecrets(s))
+	}
+}
+
+// machineReadableOutput checks if g10k prints a document like a SBOM or JSON report to stdout, which must not be mixed with log messages
+func machineReadableOutput() bool {
+	return len(sbomFormat) > 0 || outdatedFormat == "json" || lintFormat == "json" || lintFormat == "sarif" || (diffMode && diffFormat == "json") || (fmtMode && dryRun)
+}
+
+// logOutput returns stderr if stdout is reserved for machine readable output and stdout otherwise
+func logOutput() io.Writer {
+	if machineReadableOutput() {
+		return os.Stderr
 	}
+	return os.Stdout
 }
 
 // Validatef is a helper function for validation logging if global variable validate is set to true
@@ -67,17 +128,22 @@ func Validatef() {
 
 // Warnf is a helper function for warning logging
 func Warnf(s string) {
-	color.Set(color.FgYellow)
-	fmt.Println(s)
-	color.Unset()
+	color.New(color.FgYellow).Fprintln(logOutput(), redactSecrets(s))
 }
 
 // Fatalf is a helper function for fatal logging
 func Fatalf(s string) {
+	s = redactSecrets(s)
 	if validate {
 		validationMessages = append(validationMessages, s)
 	} else {
+		if interrupted() {
+			// the signal handler removes the incomplete paths and exits, errors of the cancelled work are expected
+			Debugf(s)
+			select {}
+		}
 		color.New(color.FgRed).Fprintln(os.Stderr, s)
+		removeTempPaths()
 		os.Exit(1)
 	}
 }
@@ -170,7 +236,7 @@ func purgeDir(dir string, callingFunction string) {
 	}
 }
 
-func executeCommand(command string, commandDir string, timeout int, allowFail bool, disableHttpProxy bool) ExecResult {
+func executeCommand(command string, commandDir string, timeout int, allowFail bool, disableHttpProxy bool, extraEnv ...string) ExecResult {
 	if len(commandDir) > 0 {
 		Debugf("Executing " + command + " in cwd " + commandDir)
 	} else {
@@ -194,21 +260,30 @@ func executeCommand(command string, commandDir string, timeout int, allowFail bo
 		execCommand.Dir = commandDir
 	}
 	if disableHttpProxy {
-		Debugf("found matching NO_PROXY URL, trying to disable http_proxy and https_proxy env variables for " + command)
-		// execCommand.Env = append(os.Environ(), "http_proxy=")
-		// execCommand.Env = append(os.Environ(), "https_proxy=")
-		os.Unsetenv("http_proxy")
-		os.Unsetenv("https_proxy")
-		os.Unsetenv("HTTP_PROXY")
-		os.Unsetenv("HTTPS_PROXY")
-	}
-	execCommand.Env = os.Environ()
-	out, err := execCommand.CombinedOutput()
+		Debugf("found matching NO_PROXY URL, disabling the proxy environment variables for " + command)
+	}
+	execCommand.Env = commandEnv(disableHttpProxy, extraEnv)
+	var out bytes.Buffer
+	execCommand.Stdout = &out
+	execCommand.Stderr = &out
+	var timedOut int32
+	stopTimer, err := startCommandWithTimeout(execCommand, timeout, &timedOut)
+	if err == nil {
+		err = execCommand.Wait()
+	}
+	stopTimer()
 	duration := time.Since(before).Seconds()
-	er := ExecResult{0, string(out)}
+	er := ExecResult{returnCode: 0, output: out.String()}
 	if msg, ok := err.(*exec.ExitError); ok { // there is error code
 		er.returnCode = msg.Sys().(syscall.WaitStatus).ExitStatus()
 	}
+	if err != nil && atomic.LoadInt32(&timedOut) == 1 {
+		er.timedOut = true
+		er.returnCode = 1
+		er.output = "Error: command " + command + " timed out after " + strconv.Itoa(timeout) + "s and was killed " + out.String()
+		Warnf("WARN: command " + command + " timed out after " + strconv.Itoa(timeout) + "s and was killed")
+		return er
+	}
 	if (allowFail || config.UseCacheFallback) && err != nil {
 		Debugf("Executing " + command + " took " + strconv.FormatFloat(duration, 'f', 5, 64) + "s")
 	} else {
@@ -216,11 +291,40 @@ func executeCommand(command string, commandDir string, timeout int, allowFail bo
 	}
 	if err != nil {
 		er.returnCode = 1
-		er.output = fmt.Sprint(err) + " " + fmt.Sprint(string(out))
+		er.output = fmt.Sprint(err) + " " + out.String()
 	}
 	return er
 }
 
+// startCommandWithTimeout starts the command in its own process group and kills the whole group, including spawned ssh processes, if it is still running after timeout seconds or if g10k gets interrupted. The returned function needs to be called after the command has finished
+func startCommandWithTimeout(cmd *exec.Cmd, timeout int, timedOut *int32) (func(), error) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		return func() {}, err
+	}
+	pid := cmd.Process.Pid
+	done := make(chan struct{})
+	go func() {
+		// kill the whole process group if g10k gets interrupted
+		select {
+		case <-workCtx.Done():
+			_ = syscall.Kill(-pid, syscall.SIGKILL)
+		case <-done:
+		}
+	}()
+	if timeout <= 0 {
+		return func() { close(done) }, nil
+	}
+	timer := time.AfterFunc(time.Duration(timeout)*time.Second, func() {
+		atomic.StoreInt32(timedOut, 1)
+		_ = syscall.Kill(-pid, syscall.SIGKILL)
+	})
+	return func() {
+		timer.Stop()
+		close(done)
+	}, nil
+}
+
 // funcName return the function name as a string
 func funcName() string {
 	pc, _, _, _ := runtime.Caller(1)
@@ -251,7 +355,7 @@ func checkForAndExecutePostrunCommand() {
 		postrunCommandString = strings.Replace(postrunCommandString, "$modifiedenvs", needSyncEnvText, -1)
 		postrunCommandString = strings.Replace(postrunCommandString, "$branchparam", branchParam, -1)
 
-		er := executeCommand(postrunCommandString, "", config.Timeout, false, false)
+		er := executeCommand(postrunCommandString, "", postrunTimeout(), false, false)
 		Debugf("postrun command '" + postrunCommandString + "' terminated with exit code " + strconv.Itoa(er.returnCode))
 	}
 }
@@ -315,7 +419,7 @@ func writeStructJSONFile(file string, v interface{}) {
 		Warnf("Could not encode JSON file " + file + " " + err.Error())
 	}
 
-	err = ioutil.WriteFile(file, content, 0644)
+	err = writeFileAtomic(file, content, 0644)
 	if err != nil {
 		Warnf("Could not write JSON file " + file + " " + err.Error())
 	}
@@ -351,25 +455,140 @@ func stripComponent(component string, env string) string {
 	}
 }
 
-func matchGitRemoteURLNoProxy(url string) bool {
-	noProxy := os.Getenv("NO_PROXY")
-	for _, np := range strings.Split(noProxy, ",") {
-		if len(np) > 0 {
-			if strings.Contains(url, np) {
-				Debugf("found NO_PROXY setting: " + np + " matching  " + url)
+// proxyEnvNames contains the environment variables that configure the HTTP proxy of git and curl
+var proxyEnvNames = []string{"http_proxy", "https_proxy", "HTTP_PROXY", "HTTPS_PROXY", "all_proxy", "ALL_PROXY"}
+
+// commandEnv returns the environment of an external command, without changing the environment of g10k itself
+func commandEnv(disableHttpProxy bool, extraEnv []string) []string {
+	env := []string{}
+	for _, e := range os.Environ() {
+		if disableHttpProxy && stringSliceContains(proxyEnvNames, strings.SplitN(e, "=", 2)[0]) {
+			continue
+		}
+		env = append(env, e)
+	}
+	// later entries take precedence over variables with the same name
+	return append(env, extraEnv...)
+}
+
+// noProxyEnv returns the NO_PROXY environment variable or its lower case variant
+func noProxyEnv() string {
+	if noProxy := os.Getenv("NO_PROXY"); len(noProxy) > 0 {
+		return noProxy
+	}
+	return os.Getenv("no_proxy")
+}
+
+// matchNoProxy checks if the given host and optional port match the NO_PROXY environment variable.
+// Entries can be * for all hosts, IP addresses, CIDR ranges or domain names, which also match their subdomains.
+// Domain names with a leading . or *. only match subdomains and entries with a port only match that port.
+func matchNoProxy(host string, port string) bool {
+	host = strings.ToLower(strings.TrimSuffix(strings.Trim(host, "[]"), "."))
+	if len(host) == 0 {
+		return false
+	}
+	ip := net.ParseIP(host)
+	for _, np := range strings.Split(noProxyEnv(), ",") {
+		np = strings.ToLower(strings.TrimSpace(np))
+		if i := strings.Index(np, "://"); i >= 0 {
+			// tolerate entries with a URL scheme like https://git.domain.tld
+			np = strings.TrimSuffix(np[i+3:], "/")
+		}
+		if len(np) == 0 {
+			continue
+		}
+		if np == "*" {
+			return true
+		}
+		if _, cidr, err := net.ParseCIDR(np); err == nil {
+			if ip != nil && cidr.Contains(ip) {
 				return true
 			}
+			continue
 		}
-	}
-	// do the same for lower case environment variable name
-	noProxyL := os.Getenv("no_proxy")
-	for _, np := range strings.Split(noProxyL, ",") {
-		if len(np) > 0 {
-			if strings.Contains(url, np) {
-				Debugf("found no_proxy setting: " + np + " matching  " + url)
+		npHost, npPort := np, ""
+		if h, p, err := net.SplitHostPort(np); err == nil {
+			npHost, npPort = h, p
+		}
+		if len(npPort) > 0 && npPort != port {
+			continue
+		}
+		if npIP := net.ParseIP(npHost); npIP != nil {
+			if ip != nil && npIP.Equal(ip) {
 				return true
 			}
+			continue
+		}
+		npHost = strings.TrimSuffix(npHost, ".")
+		if strings.HasPrefix(npHost, "*.") || strings.HasPrefix(npHost, ".") {
+			if strings.HasSuffix(host, "."+strings.TrimLeft(npHost, "*.")) {
+				return true
+			}
+		} else if host == npHost || strings.HasSuffix(host, "."+npHost) {
+			return true
 		}
 	}
 	return false
 }
+
+// matchGitRemoteURLNoProxy checks if the host of the given git remote URL matches the NO_PROXY environment variable
+func matchGitRemoteURLNoProxy(gitURL string) bool {
+	port := ""
+	if u, err := url.Parse(gitURL); err == nil && strings.Contains(gitURL, "://") {
+		port = u.Port()
+		if len(port) == 0 && u.Scheme == "https" {
+			port = "443"
+		} else if len(port) == 0 && u.Scheme == "http" {
+			port = "80"
+		}
+	}
+	if matchNoProxy(gitURLHost(gitURL), port) {
+		Debugf("found NO_PROXY setting matching " + gitURL)
+		return true
+	}
+	return false
+}
+
+// httpProxyFunc returns the proxy function for HTTP requests, which uses the given configured proxy unless the host matches NO_PROXY and falls back to the proxy environment variables
+func httpProxyFunc(proxy string) func(*http.Request) (*url.URL, error) {
+	return func(req *http.Request) (*url.URL, error) {
+		if len(proxy) == 0 {
+			return http.ProxyFromEnvironment(req)
+		}
+		port := req.URL.Port()
+		if len(port) == 0 && req.URL.Scheme == "https" {
+			port = "443"
+		} else if len(port) == 0 {
+			port = "80"
+		}
+		if matchNoProxy(req.URL.Hostname(), port) {
+			return nil, nil
+		}
+		return url.Parse(proxy)
+	}
+}
+
+// forgeProxy returns the configured forge.proxy or proxy setting
+func forgeProxy() string {
+	if len(config.Forge.Proxy) > 0 {
+		return config.Forge.Proxy
+	}
+	return config.Proxy
+}
+
+// gitProxyEnv returns the proxy environment variables for git commands accessing the given HTTP(S) git remote URL if git.proxy or proxy is configured
+func gitProxyEnv(gitURL string) []string {
+	proxy := gitProxy()
+	if len(proxy) == 0 || !(strings.HasPrefix(gitURL, "https://") || strings.HasPrefix(gitURL, "http://")) || matchGitRemoteURLNoProxy(gitURL) {
+		return []string{}
+	}
+	return []string{"http_proxy=" + proxy, "https_proxy=" + proxy, "HTTP_PROXY=" + proxy, "HTTPS_PROXY=" + proxy}
+}
+
+// gitProxy returns the configured git.proxy or proxy setting
+func gitProxy() string {
+	if len(config.Git.Proxy) > 0 {
+		return config.Git.Proxy
+	}
+	return config.Proxy
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"io"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// HostLimiter limits the concurrent operations and the operations per second against a single git or Forge host
+type HostLimiter struct {
+	slots    chan struct{}
+	interval time.Duration
+	mutex    sync.Mutex
+	next     time.Time
+}
+
+// hostLimiters contains the limiters of all git and Forge hosts of this g10k run
+var hostLimiters = struct {
+	sync.Mutex
+	m map[string]*HostLimiter
+}{m: make(map[string]*HostLimiter)}
+
+// newHostLimiter returns a limiter with the given number of concurrent slots and requests per second, zero disables the limit
+func newHostLimiter(limit int, requestsPerSecond float64) *HostLimiter {
+	hl := &HostLimiter{}
+	if limit > 0 {
+		hl.slots = make(chan struct{}, limit)
+	}
+	if requestsPerSecond > 0 {
+		hl.interval = time.Duration(float64(time.Second) / requestsPerSecond)
+	}
+	return hl
+}
+
+// acquire blocks until a slot of the host is free and the rate limit allows the next operation
+func (hl *HostLimiter) acquire() {
+	if hl.slots != nil {
+		hl.slots <- struct{}{}
+	}
+	if hl.interval > 0 {
+		hl.mutex.Lock()
+		now := time.Now()
+		start := hl.next
+		if start.Before(now) {
+			start = now
+		}
+		hl.next = start.Add(hl.interval)
+		hl.mutex.Unlock()
+		time.Sleep(time.Until(start))
+	}
+}
+
+// release frees the slot taken with acquire()
+func (hl *HostLimiter) release() {
+	if hl.slots != nil {
+		<-hl.slots
+	}
+}
+
+// hostLimiter returns the limiter of the given host, kind is either git or forge
+func hostLimiter(kind string, host string) *HostLimiter {
+	hostLimiters.Lock()
+	defer hostLimiters.Unlock()
+	key := kind + ":" + host
+	if hl, ok := hostLimiters.m[key]; ok {
+		return hl
+	}
+	limit, requestsPerSecond := config.Git.HostLimits[host], config.Git.RequestsPerSecond
+	if kind == "forge" {
+		limit, requestsPerSecond = config.Forge.HostLimits[host], config.Forge.RequestsPerSecond
+	}
+	if limit > 0 || requestsPerSecond > 0 {
+		Debugf("Limiting " + kind + " host " + host + " to " + strconv.Itoa(limit) + " concurrent operations and " + strconv.FormatFloat(requestsPerSecond, 'f', -1, 64) + " operations per second, 0 means unlimited")
+	}
+	hl := newHostLimiter(limit, requestsPerSecond)
+	hostLimiters.m[key] = hl
+	return hl
+}
+
+// acquireGitHost waits for the limits of the host of the given git URL and returns the function to release it again
+func acquireGitHost(gitURL string) func() {
+	hl := hostLimiter("git", gitURLHost(gitURL))
+	hl.acquire()
+	return hl.release
+}
+
+// acquireForgeHost waits for the limits of the Forge host of the given Forge module and returns the function to release it again
+func acquireForgeHost(fm ForgeModule) func() {
+	baseURL := config.ForgeBaseURL
+	if len(fm.baseURL) > 0 {
+		baseURL = fm.baseURL
+	}
+	host := ""
+	if u, err := url.Parse(baseURL); err == nil {
+		host = u.Hostname()
+	}
+	hl := hostLimiter("forge", host)
+	hl.acquire()
+	return hl.release
+}
+
+// hostLimitedBody is a HTTP response body, which releases the limits of its host once it gets closed
+type hostLimitedBody struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+}
+
+// Close closes the response body and releases the limits of its host
+func (b *hostLimitedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+// checkHostLimits validates the host_limits and requests_per_second settings of the git and forge sections
+func checkHostLimits(git Git, forge Forge) {
+	for kind, hostLimits := range map[string]map[string]int{"git": git.HostLimits, "forge": forge.HostLimits} {
+		for host, limit := range hostLimits {
+			if limit < 0 {
+				Fatalf("Error: config setting " + kind + ".host_limits of host " + host + " must not be negative in config file " + configOrigins[kind+".host_limits."+host])
+			}
+		}
+	}
+	if git.RequestsPerSecond < 0 {
+		Fatalf("Error: config setting git.requests_per_second must not be negative in config file " + configOrigins["git.requests_per_second"])
+	}
+	if forge.RequestsPerSecond < 0 {
+		Fatalf("Error: config setting forge.requests_per_second must not be negative in config file " + configOrigins["forge.requests_per_second"])
+	}
+}
+
+// resetHostLimiters forgets the host limiters of the previous g10k run, so that they get created from the current config
+func resetHostLimiters() {
+	hostLimiters.Lock()
+	hostLimiters.m = make(map[string]*HostLimiter)
+	hostLimiters.Unlock()
+}
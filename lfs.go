@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// lfsPointerMaxSize is the maximum size of a Git LFS pointer file, see https://github.com/git-lfs/git-lfs/blob/main/docs/spec.md
+const lfsPointerMaxSize = 1024
+
+// LFSBatchRequest is the request body of the Git LFS batch API
+type LFSBatchRequest struct {
+	Operation string      `json:"operation"`
+	Transfers []string    `json:"transfers"`
+	Objects   []LFSObject `json:"objects"`
+}
+
+// LFSBatchResponse is the response body of the Git LFS batch API
+type LFSBatchResponse struct {
+	Objects []LFSObject `json:"objects"`
+}
+
+// LFSObject is a single object of a Git LFS batch API request or response
+type LFSObject struct {
+	Oid     string `json:"oid"`
+	Size    int64  `json:"size"`
+	Actions *struct {
+		Download *struct {
+			Href   string            `json:"href"`
+			Header map[string]string `json:"header"`
+		} `json:"download"`
+	} `json:"actions,omitempty"`
+	Error *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error,omitempty"`
+}
+
+// parseLFSPointer returns the LFS object of the given file content if it is a Git LFS pointer file
+func parseLFSPointer(content []byte) (LFSPointer, bool) {
+	lfsPointer := LFSPointer{size: -1}
+	if !bytes.HasPrefix(content, []byte("version https://git-lfs.github.com/spec/v1\n")) {
+		return lfsPointer, false
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		if strings.HasPrefix(line, "oid sha256:") {
+			lfsPointer.oid = strings.TrimPrefix(line, "oid sha256:")
+		} else if strings.HasPrefix(line, "size ") {
+			size, err := strconv.ParseInt(strings.TrimPrefix(line, "size "), 10, 64)
+			if err != nil {
+				return lfsPointer, false
+			}
+			lfsPointer.size = size
+		}
+	}
+	if len(lfsPointer.oid) != 64 || lfsPointer.size < 0 {
+		return lfsPointer, false
+	}
+	if _, err := hex.DecodeString(lfsPointer.oid); err != nil {
+		return lfsPointer, false
+	}
+	return lfsPointer, true
+}
+
+// lfsCacheDir returns the Git LFS object cache directory of the given git module
+func lfsCacheDir(gm GitModule) string {
+	return filepath.Join(resolveSourceSettings(config.Sources[gm.source]).CacheDir, "lfs")
+}
+
+// lfsObjectPath returns the path of the LFS object with the given oid, which uses the same layout as git-lfs
+func lfsObjectPath(baseDir string, oid string) string {
+	return filepath.Join(baseDir, oid[0:2], oid[2:4], oid)
+}
+
+// lfsEndpoint returns the Git LFS server URL of the given git remote, which can be overridden with lfs.url in the .lfsconfig file of the repository
+func lfsEndpoint(gitURL string, srcDir string, tree string) string {
+	if len(srcDir) > 0 {
+		er := executeCommand("git --git-dir "+srcDir+" config --blob "+tree+":.lfsconfig --get lfs.url", "", gitModuleTimeout(GitModule{}), true, false)
+		if er.returnCode == 0 && len(strings.TrimSpace(er.output)) > 0 {
+			return strings.TrimSuffix(strings.TrimSpace(er.output), "/")
+		}
+	}
+	endpoint := strings.TrimSuffix(gitURL, "/")
+	if len(lfsLocalObjectDir(gitURL)) > 0 {
+		// local repositories have no LFS server
+		return ""
+	}
+	if strings.HasPrefix(endpoint, "ssh://") || strings.HasPrefix(endpoint, "git://") {
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return ""
+		}
+		endpoint = "https://" + u.Hostname() + u.Path
+	} else if !strings.Contains(endpoint, "://") {
+		// scp-like syntax, e.g. git@github.com:xorpaul/g10k.git
+		host := gitURLHost(endpoint)
+		if len(host) == 0 {
+			return ""
+		}
+		endpoint = "https://" + host + "/" + strings.TrimPrefix(endpoint[strings.Index(endpoint, ":")+1:], "/")
+	}
+	if !strings.HasSuffix(endpoint, ".git") {
+		endpoint = endpoint + ".git"
+	}
+	return endpoint + "/info/lfs"
+}
+
+// lfsLocalObjectDir returns the LFS object directory of git remotes that are local paths
+func lfsLocalObjectDir(gitURL string) string {
+	path := gitURL
+	if strings.HasPrefix(path, "file://") {
+		path = strings.TrimPrefix(path, "file://")
+	} else if !strings.HasPrefix(path, "/") {
+		return ""
+	}
+	if isDir(filepath.Join(path, ".git", "lfs", "objects")) {
+		return filepath.Join(path, ".git", "lfs", "objects")
+	}
+	return filepath.Join(path, "lfs", "objects")
+}
+
+// materializeLFSObjects replaces the extracted Git LFS pointer files with the LFS objects, which get cached in cachedir/lfs
+func materializeLFSObjects(gitModule GitModule, srcDir string, tree string, lfsPointers []LFSPointer) {
+	cacheDir := lfsCacheDir(gitModule)
+	missing := make(map[string]LFSPointer)
+	for _, p := range lfsPointers {
+		if !fileExists(lfsObjectPath(cacheDir, p.oid)) {
+			missing[p.oid] = p
+		}
+	}
+	errs := make(map[string]string)
+	if len(missing) > 0 {
+		checkDirAndCreate(cacheDir, "cachedir/lfs")
+		errs = fetchLFSObjects(gitModule, srcDir, tree, cacheDir, missing)
+	}
+
+	for _, p := range lfsPointers {
+		objectFile := lfsObjectPath(cacheDir, p.oid)
+		if !fileExists(objectFile) {
+			reason := errs[p.oid]
+			if len(reason) == 0 {
+				reason = "object not found"
+			}
+			if config.ErrorMissingLFSObject {
+				Fatalf("Error: Unable to fetch Git LFS object " + p.oid + " for " + p.file + " from " + gitModule.git + " Error: " + reason)
+			}
+			Warnf("WARN: Unable to fetch Git LFS object " + p.oid + " for " + p.file + " from " + gitModule.git + ", keeping the LFS pointer file. Error: " + reason)
+			continue
+		}
+		Debugf("Replacing Git LFS pointer file " + p.file + " with object " + objectFile)
+		if err := copyLFSObject(objectFile, p); err != nil {
+			Fatalf("materializeLFSObjects(): Error while replacing Git LFS pointer file " + p.file + " with object " + objectFile + " Error: " + err.Error())
+		}
+	}
+}
+
+// copyLFSObject writes the cached LFS object to the location of the pointer file
+func copyLFSObject(objectFile string, p LFSPointer) error {
+	in, err := os.Open(objectFile)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(p.file)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err = out.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(p.file, p.mode); err != nil {
+		return err
+	}
+	return os.Chtimes(p.file, p.modTime, p.modTime)
+}
+
+// fetchLFSObjects downloads the given LFS objects into the cache directory and returns the errors of the objects that could not be fetched
+func fetchLFSObjects(gitModule GitModule, srcDir string, tree string, cacheDir string, objects map[string]LFSPointer) map[string]string {
+	errs := make(map[string]string)
+	endpoint := lfsEndpoint(gitModule.git, srcDir, tree)
+	if localObjectDir := lfsLocalObjectDir(gitModule.git); len(endpoint) == 0 && len(localObjectDir) > 0 {
+		for oid, p := range objects {
+			f, err := os.Open(lfsObjectPath(localObjectDir, oid))
+			if err != nil {
+				errs[oid] = err.Error()
+				continue
+			}
+			if err = storeLFSObject(cacheDir, p, f); err != nil {
+				errs[oid] = err.Error()
+			}
+			f.Close()
+		}
+		return errs
+	}
+	if len(endpoint) == 0 {
+		for oid := range objects {
+			errs[oid] = "unable to detect the Git LFS endpoint"
+		}
+		return errs
+	}
+	batchRequest := LFSBatchRequest{Operation: "download", Transfers: []string{"basic"}}
+	for _, p := range objects {
+		batchRequest.Objects = append(batchRequest.Objects, LFSObject{Oid: p.oid, Size: p.size})
+	}
+	body, _ := json.Marshal(batchRequest)
+	Debugf("Requesting " + strconv.Itoa(len(objects)) + " Git LFS objects from " + endpoint)
+	resp, err := lfsRequest("POST", endpoint+"/objects/batch", bytes.NewReader(body), map[string]string{}, endpoint)
+	if err != nil {
+		for oid := range objects {
+			errs[oid] = err.Error()
+		}
+		return errs
+	}
+	var batchResponse LFSBatchResponse
+	err = json.NewDecoder(resp.Body).Decode(&batchResponse)
+	resp.Body.Close()
+	if err != nil {
+		for oid := range objects {
+			errs[oid] = "invalid Git LFS batch API response: " + err.Error()
+		}
+		return errs
+	}
+
+	for _, o := range batchResponse.Objects {
+		p, ok := objects[o.Oid]
+		if !ok {
+			continue
+		}
+		if o.Error != nil {
+			errs[o.Oid] = "HTTP " + strconv.Itoa(o.Error.Code) + " " + o.Error.Message
+			continue
+		}
+		if o.Actions == nil || o.Actions.Download == nil {
+			errs[o.Oid] = "no download action in Git LFS batch API response"
+			continue
+		}
+		before := time.Now()
+		resp, err := lfsRequest("GET", o.Actions.Download.Href, nil, o.Actions.Download.Header, endpoint)
+		if err != nil {
+			errs[o.Oid] = err.Error()
+			continue
+		}
+		err = storeLFSObject(cacheDir, p, resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			errs[o.Oid] = err.Error()
+			continue
+		}
+		Verbosef("Downloading Git LFS object " + o.Oid + " took " + strconv.FormatFloat(time.Since(before).Seconds(), 'f', 5, 64) + "s")
+	}
+	return errs
+}
+
+// lfsRequest issues a HTTP request to the Git LFS server, the git.credentials of the LFS endpoint are used if the request has no Authorization header
+func lfsRequest(method string, requestURL string, body io.Reader, header map[string]string, endpoint string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(workCtx, method, requestURL, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "https://github.com/xorpaul/g10k/")
+	req.Header.Set("Accept", "application/vnd.git-lfs+json")
+	if method == "POST" {
+		req.Header.Set("Content-Type", "application/vnd.git-lfs+json")
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	if len(req.Header.Get("Authorization")) == 0 {
+		if c, ok := matchGitCredential(endpoint); ok && len(c.Token) > 0 {
+			req.Header.Set("Authorization", gitCredentialAuthorization(c))
+		}
+	}
+	proxyURL, err := httpProxyFunc(gitProxy())(req)
+	if err != nil {
+		return nil, err
+	}
+	// the timeout includes reading the body, so large LFS objects get the clone timeout
+	timeout := time.Duration(gitCommandTimeout(GitModule{}, "clone")) * time.Second
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}, Timeout: timeout}
+	releaseHost := acquireGitHost(requestURL)
+	resp, err := client.Do(req)
+	if err != nil {
+		releaseHost()
+		return nil, err
+	}
+	// the host stays taken until the caller closed the response body
+	resp.Body = &hostLimitedBody{ReadCloser: resp.Body, release: releaseHost}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, errors.New("unexpected HTTP status " + resp.Status + " for " + method + " " + requestURL)
+	}
+	return resp, nil
+}
+
+// storeLFSObject writes the LFS object into the cache directory after verifying its size and sha256 sum
+func storeLFSObject(cacheDir string, p LFSPointer, r io.Reader) error {
+	objectFile := lfsObjectPath(cacheDir, p.oid)
+	checkDirAndCreate(filepath.Dir(objectFile), "cachedir/lfs object dir")
+	// write to a temporary file first, so that concurrent extractions never see a partial object
+	tmpFile, err := ioutil.TempFile(filepath.Dir(objectFile), p.oid+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmpFile, hash), r)
+	tmpFile.Close()
+	if err != nil {
+		return err
+	}
+	if size != p.size {
+		return errors.New("size " + strconv.FormatInt(size, 10) + " of Git LFS object does not match the expected size " + strconv.FormatInt(p.size, 10))
+	}
+	if sum := hex.EncodeToString(hash.Sum(nil)); sum != p.oid {
+		return errors.New("calculated sha256sum " + sum + " of Git LFS object does not match its oid")
+	}
+	return os.Rename(tmpFile.Name(), objectFile)
+}
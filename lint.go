@@ -0,0 +1,466 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+// PuppetfileEntry is a single module declaration of a Puppetfile including its line number and comments
+type PuppetfileEntry struct {
+	name       string
+	line       int
+	moduleDir  string
+	version    string
+	attributes []PuppetfileAttribute
+	comments   []string
+}
+
+// PuppetfileAttribute is a single :key => value attribute of a module declaration
+type PuppetfileAttribute struct {
+	key   string
+	value string
+}
+
+// PuppetfileLayout contains the parsed module declarations of a Puppetfile together with all other settings
+type PuppetfileLayout struct {
+	preamble   []string
+	moduleDirs []string
+	entries    []PuppetfileEntry
+	quotes     map[int][]string
+}
+
+// LintFinding is a single problem found by -lint
+type LintFinding struct {
+	File    string `json:"file"`
+	Line    int    `json:"line"`
+	Rule    string `json:"rule"`
+	Level   string `json:"level"`
+	Message string `json:"message"`
+}
+
+// lintRules contains the descriptions of all -lint rules
+var lintRules = map[string]string{
+	"duplicate-module":       "Puppet module is declared more than once",
+	"unpinned-forge-version": "Forge module is not pinned to a version",
+	"unpinned-git-module":    "git module is not pinned to a tag or commit",
+	"invalid-module-name":    "Puppet module name does not follow the module naming guidelines",
+	"deprecated-module":      "Forge module has been deprecated by its author",
+	"unreachable-repository": "git repository of the module is unreachable",
+	"mixed-quoting":          "Puppetfile mixes single and double quotes",
+}
+
+var reLintModule = regexp.MustCompile(`^\s*mod\s+(?:'([^']+)'|"([^"]+)")\s*,?(.*)$`)
+var reLintModuleDir = regexp.MustCompile(`^\s*moduledir\s+['"]?([^'"]+)['"]?`)
+var reLintDirective = regexp.MustCompile(`^\s*(?:forge|moduledir)\b`)
+var reLintToken = regexp.MustCompile(`(?::([\w-]+)\s*=>\s*)?('[^']*'|"[^"]*"|:[\w-]+|[\w.-]+)`)
+var reLintQuote = regexp.MustCompile(`'[^']*'|"[^"]*"`)
+var reLintForgeBaseURL = regexp.MustCompile(`^forge.base(?:URL|Url)\s+['"]?([^'"]+)['"]?`)
+var reLintModuleName = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// unquotePuppetfileValue removes the quotes of a Puppetfile string literal
+func unquotePuppetfileValue(value string) string {
+	if len(value) >= 2 && (value[0] == '\'' || value[0] == '"') && value[len(value)-1] == value[0] {
+		return value[1 : len(value)-1]
+	}
+	return value
+}
+
+// parsePuppetfileLayout parses the module declarations of the given Puppetfile content without failing on duplicate or invalid modules
+func parsePuppetfileLayout(content string) PuppetfileLayout {
+	layout := PuppetfileLayout{quotes: make(map[int][]string)}
+	moduleDir := "modules"
+	var current *PuppetfileEntry
+	comments := []string{}
+	seenModule := false
+	for i, line := range strings.Split(content, "\n") {
+		lineNumber := i + 1
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "#") {
+			comments = append(comments, trimmed)
+			continue
+		}
+		for _, q := range reLintQuote.FindAllString(line, -1) {
+			layout.quotes[lineNumber] = append(layout.quotes[lineNumber], q[:1])
+		}
+		if len(trimmed) == 0 {
+			if !seenModule && len(comments) > 0 {
+				layout.preamble = append(layout.preamble, comments...)
+				layout.preamble = append(layout.preamble, "")
+				comments = []string{}
+			}
+			continue
+		}
+		if m := reLintModule.FindStringSubmatch(line); len(m) > 1 {
+			seenModule = true
+			layout.entries = append(layout.entries, PuppetfileEntry{name: m[1] + m[2], line: lineNumber, moduleDir: moduleDir, comments: comments})
+			comments = []string{}
+			current = &layout.entries[len(layout.entries)-1]
+			parsePuppetfileAttributes(current, m[3])
+		} else if reLintDirective.MatchString(line) {
+			current = nil
+			if m := reLintModuleDir.FindStringSubmatch(line); len(m) > 1 {
+				seenModule = true
+				moduleDir = normalizeDir(m[1])
+				if !stringSliceContains(layout.moduleDirs, moduleDir) {
+					layout.moduleDirs = append(layout.moduleDirs, moduleDir)
+				}
+			} else {
+				layout.preamble = append(layout.preamble, comments...)
+				layout.preamble = append(layout.preamble, trimmed)
+			}
+			comments = []string{}
+		} else if current != nil {
+			current.comments = append(current.comments, comments...)
+			comments = []string{}
+			parsePuppetfileAttributes(current, trimmed)
+		} else {
+			layout.preamble = append(layout.preamble, comments...)
+			layout.preamble = append(layout.preamble, trimmed)
+			comments = []string{}
+		}
+	}
+	if len(comments) > 0 && len(layout.entries) > 0 {
+		last := &layout.entries[len(layout.entries)-1]
+		last.comments = append(last.comments, comments...)
+	}
+	return layout
+}
+
+// parsePuppetfileAttributes adds the version and :key => value attributes of the given module declaration text to the entry
+func parsePuppetfileAttributes(entry *PuppetfileEntry, text string) {
+	if i := strings.Index(text, " #"); i >= 0 && strings.Count(text[:i], "'")%2 == 0 && strings.Count(text[:i], "\"")%2 == 0 {
+		text = text[:i]
+	}
+	for _, m := range reLintToken.FindAllStringSubmatch(text, -1) {
+		if len(m[1]) > 0 {
+			entry.attributes = append(entry.attributes, PuppetfileAttribute{key: m[1], value: m[2]})
+		} else if len(entry.version) == 0 && len(entry.attributes) == 0 {
+			entry.version = m[2]
+		}
+	}
+}
+
+// attribute returns the unquoted value of the given attribute of the module declaration
+func (e PuppetfileEntry) attribute(key string) (string, bool) {
+	for _, a := range e.attributes {
+		if a.key == key || strings.Replace(a.key, "-", "_", -1) == key {
+			return unquotePuppetfileValue(a.value), true
+		}
+	}
+	return "", false
+}
+
+// isGit checks if the module declaration is a git or local module
+func (e PuppetfileEntry) isGit() bool {
+	_, git := e.attribute("git")
+	_, local := e.attribute("local")
+	return git || local || !reUpdateModuleNameSeparator.MatchString(e.name)
+}
+
+// shortName returns the module name without the Forge author
+func (e PuppetfileEntry) shortName() string {
+	if i := strings.Index(e.name, "/"); i >= 0 {
+		return e.name[i+1:]
+	}
+	if e.isGit() {
+		return e.name
+	}
+	return reUpdateModuleNameSeparator.Split(e.name, 2)[1]
+}
+
+// lintPuppetfile returns all problems of the given Puppetfile
+func lintPuppetfile(file string) []LintFinding {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		Fatalf("lintPuppetfile(): Error while reading Puppetfile " + file + " Error: " + err.Error())
+	}
+	layout := parsePuppetfileLayout(string(content))
+	findings := []LintFinding{}
+	add := func(line int, rule string, level string, message string) {
+		findings = append(findings, LintFinding{File: file, Line: line, Rule: rule, Level: level, Message: message})
+	}
+
+	forgeBaseURL := config.ForgeBaseURL
+	for _, line := range layout.preamble {
+		if m := reLintForgeBaseURL.FindStringSubmatch(line); len(m) > 1 {
+			forgeBaseURL = m[1]
+		}
+	}
+
+	seen := make(map[string]PuppetfileEntry)
+	for _, e := range layout.entries {
+		name := e.shortName()
+		if first, ok := seen[name]; ok {
+			add(e.line, "duplicate-module", "error", "Module "+e.name+" is already declared in moduledir "+first.moduleDir+" in line "+strconv.Itoa(first.line))
+		} else {
+			seen[name] = e
+		}
+		if !reLintModuleName.MatchString(name) {
+			add(e.line, "invalid-module-name", "warning", "Module name "+name+" is invalid, see module guidelines: https://docs.puppet.com/puppet/latest/reference/lang_reserved.html#modules")
+		}
+		if local, _ := e.attribute("local"); local == "true" {
+			continue
+		}
+		if e.isGit() {
+			gitURL, ok := e.attribute("git")
+			if !ok {
+				continue
+			}
+			_, tag := e.attribute("tag")
+			_, commit := e.attribute("commit")
+			if !tag && !commit {
+				add(e.line, "unpinned-git-module", "warning", "git module "+e.name+" is not pinned to a :tag or :commit")
+			}
+			gm := GitModule{git: gitURL}
+			er := executeGitRemoteCommand(gm, "git ls-remote --heads "+gitURL, "", gitCommandTimeout(gm, "fetch"), true)
+			if er.returnCode != 0 {
+				add(e.line, "unreachable-repository", "error", "git repository "+gitURL+" of module "+e.name+" is unreachable")
+			}
+			continue
+		}
+		version := unquotePuppetfileValue(e.version)
+		if len(version) == 0 || strings.TrimPrefix(version, ":") == "latest" || strings.TrimPrefix(version, ":") == "present" {
+			add(e.line, "unpinned-forge-version", "warning", "Forge module "+e.name+" is not pinned to a version")
+		}
+		comp := reUpdateModuleNameSeparator.Split(e.name, 2)
+		if body, ok := queryForgeModuleJSON(ForgeModule{author: comp[0], name: comp[1], baseURL: forgeBaseURL}); ok {
+			if deprecated := gjson.Get(body, "deprecated_at"); deprecated.Exists() && deprecated.Value() != nil {
+				message := "Forge module " + e.name + " has been deprecated by its author since " + deprecated.String()
+				if successor := gjson.Get(body, "superseded_by.slug").String(); len(successor) > 0 {
+					message += ", the author has suggested " + successor + " as its replacement"
+				}
+				add(e.line, "deprecated-module", "warning", message)
+			}
+		}
+	}
+
+	// the first quote character used in the Puppetfile is the expected one
+	lines := []int{}
+	for line := range layout.quotes {
+		lines = append(lines, line)
+	}
+	sort.Ints(lines)
+	expectedQuote := ""
+	for _, line := range lines {
+		for _, q := range layout.quotes[line] {
+			if len(expectedQuote) == 0 {
+				expectedQuote = q
+			} else if q != expectedQuote {
+				add(line, "mixed-quoting", "note", "Found "+q+" quotes, but the Puppetfile uses "+expectedQuote+" quotes")
+				break
+			}
+		}
+	}
+
+	sort.SliceStable(findings, func(i, j int) bool {
+		return findings[i].Line < findings[j].Line
+	})
+	return findings
+}
+
+// sarifReport returns the given lint findings as SARIF 2.1.0 document
+func sarifReport(findings []LintFinding) map[string]interface{} {
+	ruleIDs := []string{}
+	for id := range lintRules {
+		ruleIDs = append(ruleIDs, id)
+	}
+	sort.Strings(ruleIDs)
+	rules := []map[string]interface{}{}
+	for _, id := range ruleIDs {
+		rules = append(rules, map[string]interface{}{"id": id, "shortDescription": map[string]string{"text": lintRules[id]}})
+	}
+	results := []map[string]interface{}{}
+	for _, f := range findings {
+		results = append(results, map[string]interface{}{
+			"ruleId":  f.Rule,
+			"level":   f.Level,
+			"message": map[string]string{"text": f.Message},
+			"locations": []map[string]interface{}{{
+				"physicalLocation": map[string]interface{}{
+					"artifactLocation": map[string]string{"uri": f.File},
+					"region":           map[string]int{"startLine": f.Line},
+				},
+			}},
+		})
+	}
+	return map[string]interface{}{
+		"$schema": "https://json.schemastore.org/sarif-2.1.0.json",
+		"version": "2.1.0",
+		"runs": []map[string]interface{}{{
+			"tool":    map[string]interface{}{"driver": map[string]interface{}{"name": "g10k", "version": buildversion, "informationUri": "https://github.com/xorpaul/g10k", "rules": rules}},
+			"results": results,
+		}},
+	}
+}
+
+// printLintFindings prints the lint findings of the given Puppetfile either as text, JSON or SARIF and returns if any error or warning was found
+func printLintFindings(file string, format string) bool {
+	if format != "text" && format != "json" && format != "sarif" {
+		Fatalf("Error: unknown -lint format " + format + " Valid formats are text, json and sarif")
+	}
+	findings := lintPuppetfile(file)
+	failed := false
+	for _, f := range findings {
+		if f.Level != "note" {
+			failed = true
+		}
+	}
+	var doc interface{}
+	switch format {
+	case "json":
+		doc = map[string][]LintFinding{"findings": findings}
+	case "sarif":
+		doc = sarifReport(findings)
+	default:
+		for _, f := range findings {
+			fmt.Println(f.File + ":" + strconv.Itoa(f.Line) + ": " + f.Level + ": " + f.Message + " [" + f.Rule + "]")
+		}
+		return failed
+	}
+	content, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		Fatalf("printLintFindings(): Could not encode lint findings as JSON Error: " + err.Error())
+	}
+	fmt.Println(string(content))
+	return failed
+}
+
+// quotePuppetfileValue returns the value in single quotes, symbols and booleans are kept as they are
+func quotePuppetfileValue(value string) string {
+	if strings.HasPrefix(value, ":") || value == "true" || value == "false" {
+		return value
+	}
+	value = unquotePuppetfileValue(value)
+	if strings.Contains(value, "'") {
+		return "\"" + value + "\""
+	}
+	return "'" + value + "'"
+}
+
+// formatPuppetfileEntry returns the normalized module declaration with one attribute per line
+func formatPuppetfileEntry(e PuppetfileEntry) string {
+	lines := append([]string{}, e.comments...)
+	name := e.name
+	if !e.isGit() {
+		comp := reUpdateModuleNameSeparator.Split(e.name, 2)
+		name = comp[0] + "/" + comp[1]
+	}
+	first := "mod " + quotePuppetfileValue(name)
+	if len(e.version) > 0 {
+		first += ", " + quotePuppetfileValue(e.version)
+	}
+	order := map[string]int{"git": 0, "local": 1, "tag": 2, "commit": 3, "branch": 4, "ref": 5}
+	attributes := append([]PuppetfileAttribute{}, e.attributes...)
+	sort.SliceStable(attributes, func(i, j int) bool {
+		oi, ok := order[attributes[i].key]
+		if !ok {
+			oi = len(order)
+		}
+		oj, ok := order[attributes[j].key]
+		if !ok {
+			oj = len(order)
+		}
+		return oi < oj
+	})
+	for i, a := range attributes {
+		if i == 0 {
+			first += ","
+		}
+		line := "  :" + a.key + " => " + quotePuppetfileValue(a.value)
+		if i < len(attributes)-1 {
+			line += ","
+		}
+		if i == 0 {
+			lines = append(lines, first)
+		}
+		lines = append(lines, line)
+	}
+	if len(attributes) == 0 {
+		lines = append(lines, first)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// formatPuppetfile returns the Puppetfile content with sorted modules and normalized attribute layout, Forge modules are listed before git modules in each moduledir
+func formatPuppetfile(content string) string {
+	layout := parsePuppetfileLayout(content)
+	blocks := []string{}
+	preamble := strings.TrimSpace(strings.Join(layout.preamble, "\n"))
+	if len(preamble) > 0 {
+		blocks = append(blocks, preamble)
+	}
+	moduleDirs := append([]string{"modules"}, layout.moduleDirs...)
+	for i, moduleDir := range moduleDirs {
+		if i > 0 && moduleDir == "modules" {
+			continue
+		}
+		forge := []PuppetfileEntry{}
+		git := []PuppetfileEntry{}
+		for _, e := range layout.entries {
+			if e.moduleDir != moduleDir {
+				continue
+			}
+			if e.isGit() {
+				git = append(git, e)
+			} else {
+				forge = append(forge, e)
+			}
+		}
+		if len(forge) == 0 && len(git) == 0 {
+			continue
+		}
+		if i > 0 {
+			blocks = append(blocks, "moduledir "+quotePuppetfileValue(moduleDir))
+		}
+		sort.SliceStable(forge, func(i, j int) bool {
+			return strings.ToLower(forge[i].shortName()) < strings.ToLower(forge[j].shortName())
+		})
+		sort.SliceStable(git, func(i, j int) bool {
+			return strings.ToLower(git[i].name) < strings.ToLower(git[j].name)
+		})
+		forgeLines := []string{}
+		for _, e := range forge {
+			forgeLines = append(forgeLines, formatPuppetfileEntry(e))
+		}
+		if len(forgeLines) > 0 {
+			blocks = append(blocks, strings.Join(forgeLines, "\n"))
+		}
+		for _, e := range git {
+			blocks = append(blocks, formatPuppetfileEntry(e))
+		}
+	}
+	return strings.Join(blocks, "\n\n") + "\n"
+}
+
+// formatPuppetfileInPlace rewrites the given Puppetfile with formatPuppetfile() or only prints the result with -dryrun
+func formatPuppetfileInPlace(file string) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		Fatalf("formatPuppetfileInPlace(): Error while reading Puppetfile " + file + " Error: " + err.Error())
+	}
+	formatted := formatPuppetfile(string(content))
+	if dryRun {
+		fmt.Print(formatted)
+		return
+	}
+	if formatted == string(content) {
+		Debugf("Puppetfile " + file + " is already formatted")
+		return
+	}
+	fi, err := os.Stat(file)
+	if err != nil {
+		Fatalf("formatPuppetfileInPlace(): Error while accessing Puppetfile " + file + " Error: " + err.Error())
+	}
+	if err := ioutil.WriteFile(file, []byte(formatted), fi.Mode()); err != nil {
+		Fatalf("formatPuppetfileInPlace(): Error while writing Puppetfile " + file + " Error: " + err.Error())
+	}
+	Infof("Formatted Puppetfile " + file)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cachedGitMirrors returns all git mirrors in the global and the source specific modules and environments cache directories
+func cachedGitMirrors() []string {
+	cacheDirs := map[string]bool{config.ModulesCacheDir: true, config.EnvCacheDir: true}
+	for _, sa := range config.Sources {
+		ssa := resolveSourceSettings(sa)
+		cacheDirs[ssa.ModulesCacheDir] = true
+		cacheDirs[ssa.EnvCacheDir] = true
+	}
+	mirrors := []string{}
+	for cacheDir := range cacheDirs {
+		if len(cacheDir) == 0 {
+			continue
+		}
+		entries, _ := os.ReadDir(cacheDir)
+		for _, entry := range entries {
+			workDir := filepath.Join(cacheDir, entry.Name())
+			if !entry.IsDir() || strings.HasPrefix(entry.Name(), tempPathPrefix) || !fileExists(filepath.Join(workDir, "HEAD")) {
+				continue
+			}
+			mirrors = append(mirrors, workDir)
+		}
+	}
+	sort.Strings(mirrors)
+	return mirrors
+}
+
+// gitMirrorMaintenanceDue checks if the last maintenance of the given git mirror is older than the given interval
+func gitMirrorMaintenanceDue(workDir string, interval time.Duration) bool {
+	er := executeCommand("git --git-dir "+workDir+" config g10k.lastmaintenance", "", gitModuleTimeout(GitModule{}), true, false)
+	if er.returnCode != 0 {
+		return true
+	}
+	lastMaintenance, err := strconv.ParseInt(strings.TrimSpace(er.output), 10, 64)
+	if err != nil {
+		return true
+	}
+	return time.Since(time.Unix(lastMaintenance, 0)) >= interval
+}
+
+// maintainGitMirror packs the loose objects of the given git mirror with gc --auto and writes its commit-graph, a mirror that fails gets checked and repaired with repairGitMirror()
+func maintainGitMirror(workDir string) bool {
+	lockGitDir(workDir)
+	defer unlockGitDir(workDir)
+	Debugf("Running maintenance of git mirror " + workDir)
+	er := executeCommand("git --git-dir "+workDir+" gc --auto --quiet", "", maintenanceTimeout(), true, false)
+	if er.returnCode == 0 && gitMirrorMode(workDir) != "shallow" {
+		// shallow repositories can not use a commit-graph
+		er = executeCommand("git --git-dir "+workDir+" commit-graph write --reachable", "", maintenanceTimeout(), true, false)
+	}
+	if er.timedOut {
+		// a killed gc says nothing about the state of the mirror
+		Warnf("WARN: Maintenance of git mirror " + workDir + " timed out after " + strconv.Itoa(maintenanceTimeout()) + "s, increase timeouts.maintenance")
+		return false
+	}
+	if er.returnCode != 0 {
+		Warnf("WARN: Maintenance of git mirror " + workDir + " failed Error: " + er.output)
+		if !repairGitMirror(gitMirrorModule(workDir), workDir) {
+			return false
+		}
+	}
+	executeCommand("git --git-dir "+workDir+" config g10k.lastmaintenance "+strconv.FormatInt(time.Now().Unix(), 10), "", gitModuleTimeout(GitModule{}), false, false)
+	return true
+}
+
+// maintainGitMirrors runs the maintenance of all cached git mirrors, which were not maintained within the maintenance_interval or all of them if force is true
+func maintainGitMirrors(force bool) {
+	failed := 0
+	for _, workDir := range cachedGitMirrors() {
+		if !force && !gitMirrorMaintenanceDue(workDir, config.Git.MaintenanceInterval) {
+			Debugf("Skipping maintenance of git mirror " + workDir + ", because it was maintained in the last " + config.Git.MaintenanceInterval.String())
+			continue
+		}
+		if !maintainGitMirror(workDir) {
+			failed++
+		}
+	}
+	if failed > 0 {
+		Warnf("WARN: Maintenance of " + strconv.Itoa(failed) + " git mirrors failed, they get cloned again if their next update fails")
+	}
+}
+
+// gitMirrorRemoteURL returns the URL of the origin remote of the given git mirror
+func gitMirrorRemoteURL(workDir string) string {
+	er := executeCommand("git --git-dir "+workDir+" config remote.origin.url", "", gitModuleTimeout(GitModule{}), true, false)
+	return strings.TrimSpace(er.output)
+}
+
+// gitMirrorModule returns the git module of the given cached git mirror with the remote URL and the SSH key of the source it belongs to
+func gitMirrorModule(workDir string) GitModule {
+	gm := GitModule{git: gitMirrorRemoteURL(workDir)}
+	sources := []string{}
+	for source := range config.Sources {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+	for _, source := range sources {
+		sa := config.Sources[source]
+		ssa := resolveSourceSettings(sa)
+		if filepath.Clean(workDir) == filepath.Join(ssa.EnvCacheDir, source+".git") {
+			// the control repo of this source
+			return GitModule{git: gm.git, privateKey: sa.PrivateKey, source: source, cacheDir: ssa.ModulesCacheDir, timeout: ssa.Timeout}
+		}
+	}
+	for _, source := range sources {
+		sa := config.Sources[source]
+		ssa := resolveSourceSettings(sa)
+		if filepath.Dir(filepath.Clean(workDir)) == filepath.Clean(ssa.ModulesCacheDir) {
+			// git modules use the SSH key of the source of their Puppetfile
+			return GitModule{git: gm.git, privateKey: sa.PrivateKey, source: source, cacheDir: ssa.ModulesCacheDir, timeout: ssa.Timeout}
+		}
+	}
+	return gm
+}
+
+// gitMirrorCorrupted checks the connectivity of all objects of the given git mirror with git fsck, a timed out fsck does not count as corruption
+func gitMirrorCorrupted(workDir string) bool {
+	er := executeCommand("git --git-dir "+workDir+" fsck --connectivity-only --no-dangling --no-progress", "", maintenanceTimeout(), true, false)
+	if er.timedOut {
+		Warnf("WARN: git fsck of " + workDir + " timed out after " + strconv.Itoa(maintenanceTimeout()) + "s, increase timeouts.maintenance")
+		return false
+	}
+	if er.returnCode != 0 {
+		Debugf("git fsck of " + workDir + " failed: " + er.output)
+	}
+	return er.returnCode != 0
+}
+
+// removeEmptyLooseObjects removes the empty loose object files that interrupted writes leave behind, so that they can be fetched again
+func removeEmptyLooseObjects(workDir string) {
+	objectFiles, _ := filepath.Glob(filepath.Join(workDir, "objects", "[0-9a-f][0-9a-f]", "*"))
+	for _, objectFile := range objectFiles {
+		if fi, err := os.Stat(objectFile); err == nil && fi.Mode().IsRegular() && fi.Size() == 0 {
+			Debugf("Removing empty loose object file " + objectFile)
+			os.Remove(objectFile)
+		}
+	}
+}
+
+// repairGitMirror detects a corrupted git mirror with git fsck and tries to repair it by fetching all objects again, it returns true if the mirror is intact afterwards
+func repairGitMirror(gitModule GitModule, workDir string) bool {
+	if !gitMirrorCorrupted(workDir) {
+		Debugf("git fsck did not find any corruption in " + workDir)
+		return false
+	}
+	if len(gitModule.git) == 0 || gitMirrorMode(workDir) == "shallow" {
+		// shallow mirrors are cheaper to clone again than to repair
+		return false
+	}
+	Warnf("WARN: Found corrupted git mirror " + workDir + ", trying to repair it by fetching all objects of " + gitModule.git + " again")
+	removeEmptyLooseObjects(workDir)
+	er := executeGitRemoteCommand(gitModule, "git --git-dir "+workDir+" fetch --refetch --prune --quiet origin", "", gitCommandTimeout(gitModule, "clone"), true)
+	if er.returnCode != 0 {
+		Warnf("WARN: Could not fetch all objects of " + gitModule.git + " into " + workDir + " Error: " + er.output)
+		return false
+	}
+	if gitMirrorCorrupted(workDir) {
+		return false
+	}
+	Infof("Repaired git mirror " + workDir)
+	return true
+}
@@ -4,13 +4,16 @@ import (
 	"archive/tar"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
+	"syscall"
 )
 
-func unTar(r io.Reader, targetBaseDir string) {
+func unTar(r io.Reader, targetBaseDir string) []LFSPointer {
 	funcName := funcName()
+	lfsPointers := []LFSPointer{}
 	tarBallReader := tar.NewReader(r)
 	for {
 		header, err := tarBallReader.Next()
@@ -28,7 +31,7 @@ func unTar(r io.Reader, targetBaseDir string) {
 		// e.g puppetlabs-stdlib-6.0.0/MAINTAINERS.md for a forge module
 		// and MAINTAINERS.md for a git module
 		skiplistFilename := filename
-		if targetBaseDir == config.ForgeCacheDir {
+		if isForgeCacheDir(targetBaseDir) {
 			skiplistFilenameComponents := strings.SplitAfterN(filename, "/", 2)
 			if len(skiplistFilenameComponents) > 1 {
 				skiplistFilename = skiplistFilenameComponents[1]
@@ -67,7 +70,22 @@ func unTar(r io.Reader, targetBaseDir string) {
 			if err != nil {
 				Fatalf(funcName + "(): error while Create() file: " + filename + " Error: " + err.Error())
 			}
-			if _, err = io.Copy(writer, tarBallReader); err != nil {
+			if header.Size <= lfsPointerMaxSize {
+				// small files may be Git LFS pointers, which get replaced with the LFS object later
+				content, err := ioutil.ReadAll(tarBallReader)
+				if err != nil {
+					Fatalf(funcName + "(): error while reading file: " + filename + " Error: " + err.Error())
+				}
+				if lfsPointer, ok := parseLFSPointer(content); ok {
+					lfsPointer.file = targetFilename
+					lfsPointer.mode = os.FileMode(header.Mode)
+					lfsPointer.modTime = header.ModTime
+					lfsPointers = append(lfsPointers, lfsPointer)
+				}
+				if _, err = writer.Write(content); err != nil {
+					Fatalf(funcName + "(): error while writing file: " + filename + " Error: " + err.Error())
+				}
+			} else if _, err = io.Copy(writer, tarBallReader); err != nil {
 				Fatalf(funcName + "(): error while io.copy() file: " + filename + " Error: " + err.Error())
 			}
 			if err = os.Chmod(targetFilename, os.FileMode(header.Mode)); err != nil {
@@ -117,6 +135,7 @@ func unTar(r io.Reader, targetBaseDir string) {
 		Debugf(fmt.Sprintf("Discarded %d bytes of trailing data from tar", nread))
 		nread, err = r.Read(buf)
 	}
+	return lfsPointers
 }
 
 func matchSkiplistContent(filePath string) bool {
@@ -130,3 +149,113 @@ func matchSkiplistContent(filePath string) bool {
 	//Debugf("not skipping file " + filePath + " because no purge_skiplist pattern matches")
 	return false
 }
+
+// sameDevice checks if the given paths are located on the same device, which is required for hardlinks
+func sameDevice(a string, b string) bool {
+	var devices []uint64
+	for _, path := range []string{a, b} {
+		fileInfo, err := os.Stat(path)
+		if err != nil {
+			Fatalf("sameDevice(): Error while os.Stat file " + path)
+		}
+		if fileInfo.Sys() == nil {
+			return true
+		}
+		devices = append(devices, uint64(fileInfo.Sys().(*syscall.Stat_t).Dev))
+	}
+	return devices[0] == devices[1]
+}
+
+// copyFile copies the content, permissions and modification time of source to the new file target
+func copyFile(source string, target string, info os.FileInfo) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// populateFile creates target from the cached file source with the given link mode, auto tries reflink, hardlink and copy
+// in this order and returns the link mode that worked
+func populateFile(source string, target string, info os.FileInfo, linkMode string) (string, error) {
+	if info.Mode()&os.ModeSymlink != 0 && linkMode != "hardlink" {
+		// symlinks can not be cloned or copied, so they are recreated
+		link, err := os.Readlink(source)
+		if err != nil {
+			return linkMode, err
+		}
+		return linkMode, os.Symlink(link, target)
+	}
+	var err error
+	switch linkMode {
+	case "move":
+		// deleteSourceFileToggle is set to false as we delete the source file later in the main() anyway after the sync completes
+		return linkMode, moveFile(source, target, false)
+	case "reflink":
+		err = reflinkFile(source, target, info.Mode().Perm())
+	case "copy":
+		err = copyFile(source, target, info)
+	case "auto":
+		for _, mode := range []string{"reflink", "hardlink", "copy"} {
+			if _, err = populateFile(source, target, info, mode); err == nil {
+				Debugf("Using link mode " + mode + " to populate " + filepath.Dir(target))
+				return mode, nil
+			}
+		}
+		return linkMode, err
+	default:
+		return linkMode, os.Link(source, target)
+	}
+	if err != nil {
+		return linkMode, err
+	}
+	// unlike hardlinks the clone and the copy need the permissions and modification time of the cached file
+	if err = os.Chmod(target, info.Mode().Perm()); err != nil {
+		return linkMode, err
+	}
+	return linkMode, os.Chtimes(target, info.ModTime(), info.ModTime())
+}
+
+// linkCachedDir populates targetDir with all files of the cache directory sourceDir using the given link_mode or moves them
+// with link mode move
+func linkCachedDir(sourceDir string, targetDir string, linkMode string) {
+	funcName := funcName()
+	destination := func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			Fatalf(funcName + "(): Error while calling generic func() Error " + err.Error())
+		}
+		target, err := filepath.Rel(sourceDir, path)
+		if err != nil {
+			Fatalf(funcName + "(): Can't make " + path + " relative to " + sourceDir + " Error: " + err.Error())
+		}
+
+		if info.IsDir() {
+			if target != "." { // skip the root dir
+				err = os.Mkdir(filepath.Join(targetDir, target), os.FileMode(0755))
+				if err != nil {
+					Fatalf(funcName + "(): error while Mkdir() " + targetDir + "/" + target + " Error: " + err.Error())
+				}
+			}
+		} else {
+			// the link mode that worked for the first file of auto gets used for all other files
+			linkMode, err = populateFile(path, filepath.Join(targetDir, target), info, linkMode)
+			if err != nil {
+				Fatalf(funcName + "(): Failed to " + linkMode + " " + path + " to " + targetDir + "/" + target + " Error: " + err.Error())
+			}
+		}
+		return nil
+	}
+
+	c := make(chan error)
+	go func() { c <- filepath.Walk(sourceDir, destination) }()
+	<-c // Walk done
+}
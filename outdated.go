@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// OutdatedModule describes a deployed Puppet module for which a newer version is available
+type OutdatedModule struct {
+	Environment   string   `json:"environment"`
+	Name          string   `json:"name"`
+	Type          string   `json:"type"`
+	Deployed      string   `json:"deployed"`
+	Latest        string   `json:"latest,omitempty"`
+	LatestInMajor string   `json:"latest_in_major,omitempty"`
+	NewerTags     []string `json:"newer_tags,omitempty"`
+	Branch        string   `json:"branch,omitempty"`
+	CommitsBehind int      `json:"commits_behind,omitempty"`
+}
+
+var reSemver = regexp.MustCompile(`^[vV]?(\d+)\.(\d+)\.(\d+)$`)
+
+// parseSemver returns the major, minor and patch number of the given version, a leading v is ignored and pre-releases are not supported
+func parseSemver(version string) ([3]int, bool) {
+	var v [3]int
+	m := reSemver.FindStringSubmatch(strings.TrimSpace(version))
+	if len(m) != 4 {
+		return v, false
+	}
+	for i := 0; i < 3; i++ {
+		v[i], _ = strconv.Atoi(m[i+1])
+	}
+	return v, true
+}
+
+// compareSemver returns -1, 0 or 1 if the semantic version a is lower, equal or higher than b
+func compareSemver(a [3]int, b [3]int) int {
+	for i := 0; i < 3; i++ {
+		if a[i] < b[i] {
+			return -1
+		} else if a[i] > b[i] {
+			return 1
+		}
+	}
+	return 0
+}
+
+// newerSemverVersions returns all versions that are newer than the given current version sorted ascending
+func newerSemverVersions(current string, versions []string) []string {
+	newer := []string{}
+	cv, ok := parseSemver(current)
+	if !ok {
+		return newer
+	}
+	for _, version := range versions {
+		if v, ok := parseSemver(version); ok && compareSemver(v, cv) > 0 {
+			newer = append(newer, version)
+		}
+	}
+	sort.Slice(newer, func(i, j int) bool {
+		vi, _ := parseSemver(newer[i])
+		vj, _ := parseSemver(newer[j])
+		return compareSemver(vi, vj) < 0
+	})
+	return newer
+}
+
+// latestInMajor returns the highest of the given versions with the same major version as the current version
+func latestInMajor(current string, versions []string) string {
+	cv, _ := parseSemver(current)
+	latest := ""
+	for _, version := range versions {
+		if v, ok := parseSemver(version); ok && v[0] == cv[0] {
+			latest = version
+		}
+	}
+	return latest
+}
+
+// queryForgeModuleJSON returns the Forge API module information including all releases of the given Forge module
+func queryForgeModuleJSON(fm ForgeModule) (string, bool) {
+	baseURL := config.ForgeBaseURL
+	if len(fm.baseURL) > 0 {
+		baseURL = fm.baseURL
+	}
+	url := baseURL + "/v3/modules/" + fm.author + "-" + fm.name + "?exclude_fields=readme+changelog+license+reference"
+	req, err := http.NewRequestWithContext(workCtx, "GET", url, nil)
+	if err != nil {
+		Fatalf("queryForgeModuleJSON(): Error creating GET request for Puppetlabs forge API" + err.Error())
+	}
+	req.Header.Set("User-Agent", "https://github.com/xorpaul/g10k/")
+	proxyURL, err := httpProxyFunc(forgeProxy())(req)
+	if err != nil {
+		Fatalf("queryForgeModuleJSON(): Error while getting http proxy for request Error: " + err.Error())
+	}
+	timeout := time.Duration(gitCommandTimeout(GitModule{}, "fetch")) * time.Second
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}, Timeout: timeout}
+	releaseHost := acquireForgeHost(fm)
+	defer releaseHost()
+	resp, err := client.Do(req)
+	if err != nil {
+		Warnf("Warning: Could not query Forge API for module " + fm.author + "-" + fm.name + " Error: " + err.Error())
+		return "", false
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		Warnf("Warning: Could not query Forge API for module " + fm.author + "-" + fm.name + " using URL " + url + " HTTP status: " + resp.Status)
+		return "", false
+	}
+	return string(body), true
+}
+
+// queryForgeReleases returns all release versions of the given Forge module from the Forge API
+func queryForgeReleases(fm ForgeModule) []string {
+	versions := []string{}
+	body, ok := queryForgeModuleJSON(fm)
+	if !ok {
+		return versions
+	}
+	for _, version := range gjson.Get(body, "releases.#.version").Array() {
+		versions = append(versions, version.String())
+	}
+	if len(versions) == 0 {
+		if current := gjson.Get(body, "current_release.version").String(); len(current) > 0 {
+			versions = append(versions, current)
+		}
+	}
+	return versions
+}
+
+// gitMirrorTags returns all tags of the given git mirror
+func gitMirrorTags(gitDir string) []string {
+	er := executeCommand("git --git-dir "+gitDir+" tag -l", "", gitModuleTimeout(GitModule{}), true, false)
+	if er.returnCode != 0 {
+		Debugf("Could not list tags of " + gitDir + " Error: " + er.output)
+		return []string{}
+	}
+	return strings.Fields(er.output)
+}
+
+// gitCommitsBehind returns how many commits the given commit is behind the given branch of the git mirror
+func gitCommitsBehind(gitDir string, commit string, branch string) (int, bool) {
+	ref := "HEAD"
+	if len(branch) > 0 {
+		ref = "refs/heads/" + branch
+	}
+	er := executeCommand("git --git-dir "+gitDir+" rev-list --count "+commit+".."+ref, "", gitCommandTimeout(GitModule{}, "archive"), true, false)
+	if er.returnCode != 0 {
+		Debugf("Could not count commits between " + commit + " and " + ref + " in " + gitDir + " Error: " + er.output)
+		return 0, false
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(er.output))
+	if err != nil {
+		return 0, false
+	}
+	return count, true
+}
+
+// collectOutdatedModules returns all outdated Forge and git modules of all deployed Puppet environments
+func collectOutdatedModules() []OutdatedModule {
+	outdated := []OutdatedModule{}
+	forgeReleases := make(map[string][]string)
+	for _, de := range readDeployedEnvironments() {
+		if !de.hasPuppetfile {
+			continue
+		}
+		pf := de.puppetfile
+		for _, fm := range pf.forgeModules {
+			metadataFile := filepath.Join(pf.workDir, fm.moduleDir, fm.name, "metadata.json")
+			if !fileExists(metadataFile) {
+				continue
+			}
+			deployed := readModuleMetadata(metadataFile).version
+			moduleName := fm.author + "-" + fm.name
+			if _, ok := forgeReleases[moduleName]; !ok {
+				forgeReleases[moduleName] = queryForgeReleases(fm)
+			}
+			newer := newerSemverVersions(deployed, forgeReleases[moduleName])
+			if len(newer) == 0 {
+				continue
+			}
+			outdated = append(outdated, OutdatedModule{Environment: de.name, Name: fm.author + "/" + fm.name, Type: "forge", Deployed: deployed,
+				Latest: newer[len(newer)-1], LatestInMajor: latestInMajor(deployed, newer)})
+		}
+		for gitName, gm := range pf.gitModules {
+			if gm.local || len(gm.commit) > 0 || len(gm.ref) > 0 {
+				continue
+			}
+			gitDir := gitModuleCacheDir(gm)
+			if !isDir(gitDir) {
+				Debugf("Skipping git module " + gitName + " because its mirror " + gitDir + " does not exist")
+				continue
+			}
+			if len(gm.tag) > 0 {
+				newer := newerSemverVersions(gm.tag, gitMirrorTags(gitDir))
+				if len(newer) > 0 {
+					outdated = append(outdated, OutdatedModule{Environment: de.name, Name: gitName, Type: "git", Deployed: gm.tag, Latest: newer[len(newer)-1], NewerTags: newer})
+				}
+				continue
+			}
+			content, err := ioutil.ReadFile(filepath.Join(deployedGitModuleDir(pf, gitName, gm), ".latest_commit"))
+			if err != nil {
+				continue
+			}
+			deployed := strings.TrimSpace(string(content))
+			branch := gm.branch
+			if gm.link {
+				branch = pf.controlRepoBranch
+			}
+			if behind, ok := gitCommitsBehind(gitDir, deployed, branch); ok && behind > 0 {
+				if len(branch) == 0 {
+					branch = "HEAD"
+				}
+				outdated = append(outdated, OutdatedModule{Environment: de.name, Name: gitName, Type: "git", Deployed: shortCommit(deployed), Branch: branch, CommitsBehind: behind})
+			}
+		}
+	}
+	sort.Slice(outdated, func(i, j int) bool {
+		if outdated[i].Environment != outdated[j].Environment {
+			return outdated[i].Environment < outdated[j].Environment
+		}
+		return outdated[i].Name < outdated[j].Name
+	})
+	return outdated
+}
+
+// outdatedAvailable returns the human readable description of the newer version of an outdated module
+func outdatedAvailable(om OutdatedModule) string {
+	if om.CommitsBehind > 0 {
+		return strconv.Itoa(om.CommitsBehind) + " commits behind " + om.Branch
+	}
+	if om.Type == "forge" && om.LatestInMajor != om.Latest && len(om.LatestInMajor) > 0 {
+		return om.Latest + " (" + om.LatestInMajor + " in same major)"
+	}
+	return om.Latest
+}
+
+// printOutdatedModules prints the outdated module report either as text table, JSON or Markdown table
+func printOutdatedModules(format string) {
+	if format != "text" && format != "json" && format != "markdown" {
+		Fatalf("Error: unknown -outdated format " + format + " Valid formats are text, json and markdown")
+	}
+	outdated := collectOutdatedModules()
+	switch format {
+	case "json":
+		content, err := json.MarshalIndent(map[string][]OutdatedModule{"modules": outdated}, "", "  ")
+		if err != nil {
+			Fatalf("printOutdatedModules(): Could not encode outdated modules as JSON Error: " + err.Error())
+		}
+		fmt.Println(string(content))
+	case "markdown":
+		if len(outdated) == 0 {
+			fmt.Println("All Puppet modules are up to date.")
+			return
+		}
+		fmt.Println("| Environment | Module | Type | Deployed | Available |")
+		fmt.Println("|---|---|---|---|---|")
+		for _, om := range outdated {
+			fmt.Println("| " + om.Environment + " | " + om.Name + " | " + om.Type + " | " + om.Deployed + " | " + outdatedAvailable(om) + " |")
+		}
+	default:
+		if len(outdated) == 0 {
+			fmt.Println("All Puppet modules are up to date")
+			return
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ENVIRONMENT\tMODULE\tTYPE\tDEPLOYED\tAVAILABLE")
+		for _, om := range outdated {
+			fmt.Fprintln(w, om.Environment+"\t"+om.Name+"\t"+om.Type+"\t"+om.Deployed+"\t"+outdatedAvailable(om))
+		}
+		w.Flush()
+	}
+}
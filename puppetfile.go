@@ -5,6 +5,7 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -22,10 +23,10 @@ func sourceSanityCheck(source string, sa Source) {
 		}
 	}
 	if len(sa.Basedir) <= 0 {
-		Fatalf("resolvePuppetEnvironment(): config setting basedir is not set for source " + source + " in config file " + configFile)
+		Fatalf("resolvePuppetEnvironment(): config setting basedir is not set for source " + source + " in config file " + configOrigins["sources."+source])
 	}
 	if len(sa.Remote) <= 0 {
-		Fatalf("resolvePuppetEnvironment(): config setting remote is not set for source " + source + " in config file " + configFile)
+		Fatalf("resolvePuppetEnvironment(): config setting remote is not set for source " + source + " in config file " + configOrigins["sources."+source])
 	}
 }
 
@@ -35,6 +36,12 @@ func resolvePuppetEnvironment(tags bool, outputNameTag string) {
 	allEnvironments := make(map[string]bool)
 	allBasedirs := make(map[string]bool)
 	foundMatch := false
+	fingerprintMirrors.Lock()
+	fingerprintMirrors.m = make(map[string]bool)
+	fingerprintMirrors.Unlock()
+	resetLsRemoteCache()
+	resetHostLimiters()
+	resetUsedGitTrees()
 	for source, sa := range config.Sources {
 		wg.Add()
 		go func(source string, sa Source) {
@@ -49,22 +56,25 @@ func resolvePuppetEnvironment(tags bool, outputNameTag string) {
 			// check for a valid source that has all necessary attributes (basedir, remote, SSH key exist if given)
 			sourceSanityCheck(source, sa)
 
-			workDir := filepath.Join(config.EnvCacheDir, source+".git")
+			// source specific settings with fallback to the global config values
+			ssa := resolveSourceSettings(sa)
+			workDir := filepath.Join(ssa.EnvCacheDir, source+".git")
 			// check if sa.Basedir exists
 			checkDirAndCreate(sa.Basedir, "basedir")
 
 			controlRepoGit := GitModule{}
 			controlRepoGit.git = sa.Remote
 			controlRepoGit.privateKey = sa.PrivateKey
+			controlRepoGit.timeout = ssa.Timeout
 			if success := doMirrorOrUpdate(controlRepoGit, workDir, 0); success {
 
 				// get all branches
-				er := executeCommand("git --git-dir "+workDir+" branch", "", config.Timeout, false, false)
+				er := executeCommand("git --git-dir "+workDir+" branch", "", gitModuleTimeout(GitModule{source: source, timeout: ssa.Timeout}), false, false)
 				outputBranches := er.output
 				outputTags := ""
 
 				if tags {
-					er := executeCommand("git --git-dir "+workDir+" tag", "", config.Timeout, false, false)
+					er := executeCommand("git --git-dir "+workDir+" tag", "", gitModuleTimeout(GitModule{source: source, timeout: ssa.Timeout}), false, false)
 					outputTags = er.output
 				}
 
@@ -72,6 +82,13 @@ func resolvePuppetEnvironment(tags bool, outputNameTag string) {
 
 				foundBranch := false
 				prefix := resolveSourcePrefix(source, sa)
+				// sources with their own maxextractworker setting get a dedicated wait group for their environments
+				wgBranches := &wg
+				if sa.MaxExtractworker > 0 {
+					sourceWg := sizedwaitgroup.New(sa.MaxExtractworker)
+					wgBranches = &sourceWg
+					defer sourceWg.Wait()
+				}
 				for _, branch := range branches {
 					branch = strings.TrimLeft(branch, "* ")
 					reInvalidCharacters := regexp.MustCompile(`\W`)
@@ -114,10 +131,10 @@ func resolvePuppetEnvironment(tags bool, outputNameTag string) {
 						}
 					}
 
-					wg.Add()
+					wgBranches.Add()
 
 					go func(branch string, sa Source, prefix string) {
-						defer wg.Done()
+						defer wgBranches.Done()
 						if len(branch) != 0 {
 							Debugf("Resolving environment " + prefix + branch + " of source " + source)
 
@@ -160,22 +177,48 @@ func resolvePuppetEnvironment(tags bool, outputNameTag string) {
 							targetDir = normalizeDir(targetDir)
 
 							env := strings.Replace(strings.Replace(targetDir, sa.Basedir, "", 1), "/", "", -1)
+							unchanged, reason := environmentUnchanged(sa, ssa, source, workDir, branch, targetDir)
+							if unchanged {
+								Debugf("Skipping environment " + env + " of source " + source + ", because its " + reason)
+								// keep the environment from being purged as unmanaged content
+								mutex.Lock()
+								allBasedirs[sa.Basedir] = true
+								mutex.Unlock()
+								return
+							}
+							Debugf("Need to sync environment " + env + " of source " + source + ", because " + reason)
 							if len(moduleParam) == 0 {
 								gitModule := GitModule{}
 								gitModule.tree = branch
+								gitModule.timeout = ssa.Timeout
+								gitModule.git = sa.Remote
+								gitModule.privateKey = sa.PrivateKey
+								gitModule.source = source
+								gitModule.cacheDir = ssa.ModulesCacheDir
+								gitModule.submodules = sa.Submodules
+								gitModule.verifySignatures = sa.VerifySignatures
 								syncToModuleDir(gitModule, workDir, targetDir, env)
 							}
 							pf := filepath.Join(targetDir, "Puppetfile")
+							if diffMode {
+								// -diff mode does not populate the environment, so use the Puppetfile of the to be deployed commit
+								if pf = extractPuppetfileFromGit(workDir, branch); len(pf) > 0 {
+									defer removeTempPuppetfile(pf)
+								}
+							}
 							if !fileExists(pf) {
 								Debugf("resolvePuppetEnvironment(): Skipping branch " + source + "_" + branch + " because " + pf + " does not exist")
 								deployFile := filepath.Join(targetDir, ".g10k-deploy.json")
-								if fileExists(deployFile) {
+								if fileExists(deployFile) && !dryRun {
 									Debugf("Finishing writing to deploy file " + deployFile)
 									dr := readDeployResultFile(deployFile)
 									dr.DeploySuccess = true
 									dr.FinishedAt = time.Now()
 									dr.GitDir = sa.Basedir
 									dr.GitURL = sa.Remote
+									if len(moduleParam) == 0 {
+										dr.Fingerprint = &EnvironmentFingerprint{SettingsHash: environmentSettingsHash(ssa), ModuleDirs: []string{}, FloatingRefs: []FloatingGitRef{}}
+									}
 									writeStructJSONFile(deployFile, dr)
 								}
 							} else {
@@ -237,12 +280,99 @@ func resolveSourcePrefix(source string, sa Source) string {
 	}
 }
 
+// DeployedEnvironment contains the deploy result and the parsed Puppetfile of an already deployed Puppet environment
+type DeployedEnvironment struct {
+	name          string
+	dir           string
+	source        string
+	deployResult  DeployResult
+	puppetfile    Puppetfile
+	hasPuppetfile bool
+}
+
+// readDeployedEnvironments returns all deployed Puppet environments of all sources sorted by source and environment name, limited by the -environment and -branch parameters
+func readDeployedEnvironments() []DeployedEnvironment {
+	envs := []DeployedEnvironment{}
+	sources := []string{}
+	for source := range config.Sources {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+	for _, source := range sources {
+		sa := resolveSourceSettings(config.Sources[source])
+		prefix := resolveSourcePrefix(source, sa)
+		envDirs, _ := filepath.Glob(filepath.Join(normalizeDir(sa.Basedir), prefix+"*"))
+		sort.Strings(envDirs)
+		for _, envDir := range envDirs {
+			deployFile := filepath.Join(envDir, ".g10k-deploy.json")
+			if !isDir(envDir) || !fileExists(deployFile) {
+				continue
+			}
+			de := DeployedEnvironment{name: filepath.Base(envDir), dir: envDir, source: source, deployResult: readDeployResultFile(deployFile)}
+			if len(environmentParam) > 0 && environmentParam != de.name {
+				continue
+			}
+			if len(branchParam) > 0 && branchParam != de.deployResult.Name {
+				continue
+			}
+			if fileExists(filepath.Join(envDir, "Puppetfile")) {
+				de.puppetfile = readPuppetfile(filepath.Join(envDir, "Puppetfile"), sa.PrivateKey, source, de.deployResult.Name, false, false)
+				de.puppetfile.workDir = envDir
+				de.puppetfile.controlRepoBranch = de.deployResult.Name
+				for name, fm := range de.puppetfile.forgeModules {
+					if len(fm.cacheDir) == 0 {
+						fm.cacheDir = sa.ForgeCacheDir
+					}
+					if len(fm.baseURL) == 0 {
+						fm.baseURL = de.puppetfile.forgeBaseURL
+					}
+					de.puppetfile.forgeModules[name] = fm
+				}
+				for name, gm := range de.puppetfile.gitModules {
+					if len(gm.cacheDir) == 0 {
+						gm.cacheDir = sa.ModulesCacheDir
+					}
+					de.puppetfile.gitModules[name] = gm
+				}
+				de.hasPuppetfile = true
+			}
+			envs = append(envs, de)
+		}
+	}
+	return envs
+}
+
+// deployedGitModuleDir returns the directory the given git module of the Puppetfile is deployed to
+func deployedGitModuleDir(pf Puppetfile, gitName string, gm GitModule) string {
+	if len(gm.installPath) > 0 {
+		return normalizeDir(filepath.Join(pf.workDir, normalizeDir(gm.installPath), gitName))
+	}
+	return normalizeDir(filepath.Join(pf.workDir, gm.moduleDir, gitName))
+}
+
 func resolvePuppetfile(allPuppetfiles map[string]Puppetfile) {
 	wg := sizedwaitgroup.New(config.MaxExtractworker)
+	// sources with their own maxextractworker setting get a dedicated wait group for their modules
+	sourceWgs := make(map[string]*sizedwaitgroup.SizedWaitGroup)
+	for source, sa := range config.Sources {
+		if sa.MaxExtractworker > 0 {
+			sourceWg := sizedwaitgroup.New(sa.MaxExtractworker)
+			sourceWgs[source] = &sourceWg
+		}
+	}
 	exisitingModuleDirs := make(map[string]struct{})
 	uniqueGitModules := make(map[string]GitModule)
 	// if we made it this far initialize the global maps
 	latestForgeModules.m = make(map[string]string)
+	if pfMode {
+		// resolvePuppetEnvironment() already reset them for the control repositories
+		resetLsRemoteCache()
+		resetHostLimiters()
+		resetUsedGitTrees()
+	}
+	floatingGitRefs.Lock()
+	floatingGitRefs.m = make(map[string][]FloatingGitRef)
+	floatingGitRefs.Unlock()
 	for env, pf := range allPuppetfiles {
 		Debugf("Resolving branch " + env + " of source " + pf.source)
 		//fmt.Println(pf)
@@ -259,8 +389,15 @@ func resolvePuppetfile(allPuppetfiles map[string]Puppetfile) {
 			}
 
 			gitModule.privateKey = pf.privateKey
-			if _, ok := uniqueGitModules[gitModule.git]; !ok {
-				uniqueGitModules[gitModule.git] = gitModule
+			gitModule.refs = gitModuleRefs(gitModule, pf)
+			moduleCacheDir := gitModuleCacheDir(gitModule)
+			if um, ok := uniqueGitModules[moduleCacheDir]; !ok {
+				uniqueGitModules[moduleCacheDir] = gitModule
+			} else {
+				// the same repository can be used with different references and mirror modes in different Puppetfiles
+				um.refs = append(um.refs, gitModule.refs...)
+				um.mirrorMode = mergeMirrorModes(um.mirrorMode, gitModule.mirrorMode)
+				uniqueGitModules[moduleCacheDir] = um
 			}
 		}
 		for forgeModuleName, fm := range pf.forgeModules {
@@ -280,6 +417,10 @@ func resolvePuppetfile(allPuppetfiles map[string]Puppetfile) {
 			// fmt.Println("Found Forge module", fm.author, "/", forgeModuleName, "with version", fm.version, "and cacheTTL", fm.cacheTTL)
 			forgeModuleName = strings.Replace(forgeModuleName, "/", "-", -1)
 			uniqueForgeModuleName := fm.author + "/" + forgeModuleName + "-" + fm.version
+			if baseURL := normalizeForgeBaseURL(fm.baseURL); (len(baseURL) > 0 && baseURL != normalizeForgeBaseURL(config.ForgeBaseURL)) || forgeCacheDir(fm) != config.ForgeCacheDir {
+				// the same module version of another Forge or in another Forge cache directory is a different archive
+				uniqueForgeModuleName = baseURL + " " + forgeCacheDir(fm) + ":" + uniqueForgeModuleName
+			}
 			if _, ok := uniqueForgeModules[uniqueForgeModuleName]; !ok {
 				uniqueForgeModules[uniqueForgeModuleName] = fm
 			} else {
@@ -308,6 +449,10 @@ func resolvePuppetfile(allPuppetfiles map[string]Puppetfile) {
 	//log.Println(config.Sources["cmdlineparam"])
 	for env, pf := range allPuppetfiles {
 		Debugf("Syncing " + env + " with workDir " + pf.workDir)
+		wgModules := &wg
+		if sourceWg, ok := sourceWgs[pf.source]; ok {
+			wgModules = sourceWg
+		}
 		// this prevents g10k from purging module directories on the subsequent run in -puppetfile mode
 		basedir := ""
 		if !pfMode {
@@ -348,11 +493,12 @@ func resolvePuppetfile(allPuppetfiles map[string]Puppetfile) {
 				mutex.Unlock()
 				continue
 			}
-			wg.Add()
+			wgModules.Add()
 			go func(gitName string, gitModule GitModule, env string, pf Puppetfile) {
-				defer wg.Done()
+				defer wgModules.Done()
 				targetDir := normalizeDir(filepath.Join(moduleDir, gitName))
-				moduleCacheDir := filepath.Join(config.ModulesCacheDir, strings.Replace(strings.Replace(gitModule.git, "/", "_", -1), ":", "-", -1))
+				gitModule.privateKey = pf.privateKey
+				moduleCacheDir := gitModuleCacheDir(gitModule)
 				tree := detectDefaultBranch(moduleCacheDir)
 				Debugf("Setting " + tree + " as default branch for " + gitModule.git)
 				if len(gitModule.branch) > 0 {
@@ -434,11 +580,13 @@ func resolvePuppetfile(allPuppetfiles map[string]Puppetfile) {
 			}(gitName, gitModule, env, pf)
 		}
 		for forgeModuleName, fm := range pf.forgeModules {
-			wg.Add()
+			wgModules.Add()
+			// the Forge determines the Forge cache directory of the module
+			fm.baseURL = pf.forgeBaseURL
 			moduleDir := filepath.Join(pf.workDir, fm.moduleDir)
 			moduleDir = normalizeDir(moduleDir)
 			go func(forgeModuleName string, fm ForgeModule, moduleDir string, env string) {
-				defer wg.Done()
+				defer wgModules.Done()
 				syncForgeToModuleDir(forgeModuleName, fm, moduleDir, env)
 				// remove this module from the exisitingModuleDirs map
 				mutex.Lock()
@@ -449,11 +597,17 @@ func resolvePuppetfile(allPuppetfiles map[string]Puppetfile) {
 		}
 	}
 	wg.Wait()
+	for _, sourceWg := range sourceWgs {
+		sourceWg.Wait()
+	}
 
 	if stringSliceContains(config.PurgeLevels, "puppetfile") {
 		if len(exisitingModuleDirs) > 0 && len(moduleParam) == 0 {
 			for d := range exisitingModuleDirs {
 				Infof("Removing unmanaged path " + d)
+				if diffMode {
+					recordRemovedModuleDiff(d, allPuppetfiles)
+				}
 				if !dryRun {
 					purgeDir(d, "purge_level puppetfile")
 				}
@@ -464,9 +618,9 @@ func resolvePuppetfile(allPuppetfiles map[string]Puppetfile) {
 		uiprogress.Stop()
 	}
 
-	for _, pf := range allPuppetfiles {
+	for env, pf := range allPuppetfiles {
 		deployFile := filepath.Join(pf.workDir, ".g10k-deploy.json")
-		if fileExists(deployFile) {
+		if fileExists(deployFile) && !dryRun {
 			Debugf("Finishing writing to deploy file " + deployFile)
 			dr := readDeployResultFile(deployFile)
 			dr.DeploySuccess = true
@@ -474,6 +628,21 @@ func resolvePuppetfile(allPuppetfiles map[string]Puppetfile) {
 			dr.PuppetfileChecksum = getSha256sumFile(filepath.Join(pf.workDir, "Puppetfile"))
 			dr.GitDir = pf.gitDir
 			dr.GitURL = pf.gitURL
+			// a -module run only syncs a part of the environment
+			dr.Fingerprint = nil
+			if len(moduleParam) == 0 {
+				dr.Fingerprint = environmentFingerprint(env, pf)
+			}
+			mutex.Lock()
+			for targetDir, signer := range verifiedSigners {
+				if rel, err := filepath.Rel(pf.workDir, targetDir); err == nil && !strings.HasPrefix(rel, "..") && rel != "." {
+					if dr.ModuleSigners == nil {
+						dr.ModuleSigners = make(map[string]string)
+					}
+					dr.ModuleSigners[rel] = signer
+				}
+			}
+			mutex.Unlock()
 			writeStructJSONFile(deployFile, dr)
 		}
 	}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// reflinkFile is only supported on Linux with the FICLONE ioctl
+func reflinkFile(source string, target string, mode os.FileMode) error {
+	return errors.New("reflinks are not supported on this platform")
+}
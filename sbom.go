@@ -0,0 +1,352 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SBOMEnvironment contains the control repository and module information of a deployed Puppet environment
+type SBOMEnvironment struct {
+	name    string
+	dir     string
+	branch  string
+	commit  string
+	gitURL  string
+	modules []SBOMModule
+}
+
+// SBOMModule contains the information of a single deployed Puppet module
+type SBOMModule struct {
+	name        string
+	author      string
+	version     string
+	kind        string
+	gitURL      string
+	sha256sum   string
+	license     string
+	description string
+}
+
+// CycloneDXBOM is the CycloneDX 1.5 JSON document
+type CycloneDXBOM struct {
+	BOMFormat    string               `json:"bomFormat"`
+	SpecVersion  string               `json:"specVersion"`
+	SerialNumber string               `json:"serialNumber"`
+	Version      int                  `json:"version"`
+	Metadata     CycloneDXMetadata    `json:"metadata"`
+	Components   []CycloneDXComponent `json:"components"`
+}
+
+// CycloneDXMetadata contains the creation time and the tool that generated the CycloneDX document
+type CycloneDXMetadata struct {
+	Timestamp string              `json:"timestamp"`
+	Tools     []CycloneDXTool     `json:"tools"`
+	Component *CycloneDXComponent `json:"component,omitempty"`
+}
+
+// CycloneDXTool describes the tool that generated the CycloneDX document
+type CycloneDXTool struct {
+	Vendor  string `json:"vendor"`
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+// CycloneDXComponent describes a Puppet environment or a Puppet module
+type CycloneDXComponent struct {
+	Type               string                       `json:"type"`
+	BOMRef             string                       `json:"bom-ref"`
+	Group              string                       `json:"group,omitempty"`
+	Name               string                       `json:"name"`
+	Version            string                       `json:"version,omitempty"`
+	Description        string                       `json:"description,omitempty"`
+	Purl               string                       `json:"purl,omitempty"`
+	Hashes             []CycloneDXHash              `json:"hashes,omitempty"`
+	Licenses           []CycloneDXLicenseChoice     `json:"licenses,omitempty"`
+	ExternalReferences []CycloneDXExternalReference `json:"externalReferences,omitempty"`
+	Components         []CycloneDXComponent         `json:"components,omitempty"`
+}
+
+// CycloneDXHash contains a checksum of a component
+type CycloneDXHash struct {
+	Alg     string `json:"alg"`
+	Content string `json:"content"`
+}
+
+// CycloneDXLicenseChoice contains the license of a component
+type CycloneDXLicenseChoice struct {
+	License CycloneDXLicense `json:"license"`
+}
+
+// CycloneDXLicense is either a SPDX license id or a free text license name
+type CycloneDXLicense struct {
+	ID   string `json:"id,omitempty"`
+	Name string `json:"name,omitempty"`
+}
+
+// CycloneDXExternalReference links a component to its git repository
+type CycloneDXExternalReference struct {
+	Type string `json:"type"`
+	URL  string `json:"url"`
+}
+
+// SPDXDocument is the SPDX 2.3 JSON document
+type SPDXDocument struct {
+	SPDXVersion       string             `json:"spdxVersion"`
+	DataLicense       string             `json:"dataLicense"`
+	SPDXID            string             `json:"SPDXID"`
+	Name              string             `json:"name"`
+	DocumentNamespace string             `json:"documentNamespace"`
+	CreationInfo      SPDXCreationInfo   `json:"creationInfo"`
+	Packages          []SPDXPackage      `json:"packages"`
+	Relationships     []SPDXRelationship `json:"relationships"`
+}
+
+// SPDXCreationInfo contains the creation time and the tool that generated the SPDX document
+type SPDXCreationInfo struct {
+	Created  string   `json:"created"`
+	Creators []string `json:"creators"`
+}
+
+// SPDXPackage describes a Puppet environment or a Puppet module
+type SPDXPackage struct {
+	SPDXID           string            `json:"SPDXID"`
+	Name             string            `json:"name"`
+	VersionInfo      string            `json:"versionInfo,omitempty"`
+	Supplier         string            `json:"supplier,omitempty"`
+	DownloadLocation string            `json:"downloadLocation"`
+	FilesAnalyzed    bool              `json:"filesAnalyzed"`
+	LicenseDeclared  string            `json:"licenseDeclared"`
+	Description      string            `json:"description,omitempty"`
+	Checksums        []SPDXChecksum    `json:"checksums,omitempty"`
+	ExternalRefs     []SPDXExternalRef `json:"externalRefs,omitempty"`
+}
+
+// SPDXChecksum contains a checksum of a package
+type SPDXChecksum struct {
+	Algorithm     string `json:"algorithm"`
+	ChecksumValue string `json:"checksumValue"`
+}
+
+// SPDXExternalRef contains the purl of a package
+type SPDXExternalRef struct {
+	ReferenceCategory string `json:"referenceCategory"`
+	ReferenceType     string `json:"referenceType"`
+	ReferenceLocator  string `json:"referenceLocator"`
+}
+
+// SPDXRelationship links the SPDX document, the Puppet environments and their Puppet modules
+type SPDXRelationship struct {
+	SPDXElementID      string `json:"spdxElementId"`
+	RelationshipType   string `json:"relationshipType"`
+	RelatedSPDXElement string `json:"relatedSpdxElement"`
+}
+
+var reSPDXLicenseID = regexp.MustCompile(`^[A-Za-z0-9.+-]+$`)
+var reSPDXInvalidIDChars = regexp.MustCompile(`[^A-Za-z0-9.-]`)
+
+// collectSBOMEnvironments returns all deployed Puppet environments of all sources, limited by the -environment and -branch parameters
+func collectSBOMEnvironments() []SBOMEnvironment {
+	envs := []SBOMEnvironment{}
+	for _, de := range readDeployedEnvironments() {
+		sbomEnv := SBOMEnvironment{name: de.name, dir: de.dir, branch: de.deployResult.Name, commit: de.deployResult.Signature, gitURL: de.deployResult.GitURL}
+		if de.hasPuppetfile {
+			sbomEnv.modules = collectSBOMModules(de.puppetfile)
+		}
+		envs = append(envs, sbomEnv)
+	}
+	return envs
+}
+
+// collectSBOMModules returns the deployed Puppet modules of the given Puppetfile sorted by module name
+func collectSBOMModules(pf Puppetfile) []SBOMModule {
+	modules := []SBOMModule{}
+	for gitName, gm := range pf.gitModules {
+		if gm.local {
+			continue
+		}
+		targetDir := deployedGitModuleDir(pf, gitName, gm)
+		sm := SBOMModule{name: gitName, kind: "git", gitURL: gm.git}
+		if content, err := ioutil.ReadFile(filepath.Join(targetDir, ".latest_commit")); err == nil {
+			sm.version = strings.TrimSpace(string(content))
+		} else {
+			Debugf("Skipping git module " + gitName + " in SBOM, because " + targetDir + " was not deployed")
+			continue
+		}
+		if fileExists(filepath.Join(targetDir, "metadata.json")) {
+			metadata := readModuleMetadata(filepath.Join(targetDir, "metadata.json"))
+			sm.license = metadata.license
+			sm.description = metadata.summary
+		}
+		modules = append(modules, sm)
+	}
+	for _, fm := range pf.forgeModules {
+		fm.baseURL = pf.forgeBaseURL
+		targetDir := filepath.Join(pf.workDir, fm.moduleDir, fm.name)
+		if !fileExists(filepath.Join(targetDir, "metadata.json")) {
+			Debugf("Skipping Forge module " + fm.author + "/" + fm.name + " in SBOM, because " + targetDir + " was not deployed")
+			continue
+		}
+		metadata := readModuleMetadata(filepath.Join(targetDir, "metadata.json"))
+		sm := SBOMModule{name: fm.name, author: fm.author, kind: "forge", version: metadata.version, license: metadata.license, description: metadata.summary}
+		archive := filepath.Join(forgeCacheDir(fm), fm.author+"-"+fm.name+"-"+metadata.version+".tar.gz")
+		if fileExists(archive) {
+			sm.sha256sum = getSha256sumFile(archive)
+		} else if len(fm.sha256sum) > 0 && fm.version == metadata.version {
+			sm.sha256sum = fm.sha256sum
+		}
+		modules = append(modules, sm)
+	}
+	sort.Slice(modules, func(i, j int) bool {
+		return modules[i].name < modules[j].name
+	})
+	return modules
+}
+
+// forgePurl returns the package URL of the given Forge module
+func forgePurl(author string, name string, version string) string {
+	return "pkg:puppet/" + author + "/" + name + "@" + version
+}
+
+// newSBOMUUID returns a random version 4 UUID
+func newSBOMUUID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		Fatalf("newSBOMUUID(): Error while generating random UUID Error: " + err.Error())
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// cycloneDXLicenses returns the CycloneDX license of a Puppet module, using the SPDX id if it looks like one
+func cycloneDXLicenses(license string) []CycloneDXLicenseChoice {
+	if len(license) == 0 {
+		return nil
+	}
+	if reSPDXLicenseID.MatchString(license) {
+		return []CycloneDXLicenseChoice{{License: CycloneDXLicense{ID: license}}}
+	}
+	return []CycloneDXLicenseChoice{{License: CycloneDXLicense{Name: license}}}
+}
+
+// buildCycloneDX creates the CycloneDX document of the given Puppet environments
+func buildCycloneDX(envs []SBOMEnvironment) CycloneDXBOM {
+	bom := CycloneDXBOM{
+		BOMFormat:    "CycloneDX",
+		SpecVersion:  "1.5",
+		SerialNumber: "urn:uuid:" + newSBOMUUID(),
+		Version:      1,
+		Metadata: CycloneDXMetadata{
+			Timestamp: time.Now().UTC().Format(time.RFC3339),
+			Tools:     []CycloneDXTool{{Vendor: "xorpaul", Name: "g10k", Version: buildversion}},
+		},
+		Components: []CycloneDXComponent{},
+	}
+	for _, env := range envs {
+		ec := CycloneDXComponent{Type: "application", BOMRef: "environment:" + env.name, Name: env.name, Version: env.commit}
+		if len(env.gitURL) > 0 {
+			ec.ExternalReferences = []CycloneDXExternalReference{{Type: "vcs", URL: env.gitURL}}
+		}
+		for _, m := range env.modules {
+			mc := CycloneDXComponent{Type: "library", Name: m.name, Version: m.version, Description: m.description, Licenses: cycloneDXLicenses(m.license)}
+			if m.kind == "forge" {
+				mc.Group = m.author
+				mc.Purl = forgePurl(m.author, m.name, m.version)
+				mc.BOMRef = env.name + ":" + mc.Purl
+				if len(m.sha256sum) > 0 {
+					mc.Hashes = []CycloneDXHash{{Alg: "SHA-256", Content: m.sha256sum}}
+				}
+			} else {
+				mc.BOMRef = env.name + ":git:" + m.name + "@" + m.version
+				mc.ExternalReferences = []CycloneDXExternalReference{{Type: "vcs", URL: m.gitURL}}
+			}
+			ec.Components = append(ec.Components, mc)
+		}
+		bom.Components = append(bom.Components, ec)
+	}
+	return bom
+}
+
+// spdxID returns a valid SPDX element id for the given name
+func spdxID(name string) string {
+	return "SPDXRef-" + reSPDXInvalidIDChars.ReplaceAllString(name, "-")
+}
+
+// spdxLicense returns the license of a Puppet module as SPDX license expression
+func spdxLicense(license string) string {
+	if len(license) == 0 || !reSPDXLicenseID.MatchString(license) {
+		return "NOASSERTION"
+	}
+	return license
+}
+
+// buildSPDX creates the SPDX document of the given Puppet environments
+func buildSPDX(envs []SBOMEnvironment) SPDXDocument {
+	doc := SPDXDocument{
+		SPDXVersion:       "SPDX-2.3",
+		DataLicense:       "CC0-1.0",
+		SPDXID:            "SPDXRef-DOCUMENT",
+		Name:              "g10k-puppet-environments",
+		DocumentNamespace: "https://github.com/xorpaul/g10k/spdx/" + newSBOMUUID(),
+		CreationInfo: SPDXCreationInfo{
+			Created:  time.Now().UTC().Format(time.RFC3339),
+			Creators: []string{"Tool: g10k-" + buildversion},
+		},
+		Packages:      []SPDXPackage{},
+		Relationships: []SPDXRelationship{},
+	}
+	for _, env := range envs {
+		envID := spdxID("environment-" + env.name)
+		envPkg := SPDXPackage{SPDXID: envID, Name: env.name, VersionInfo: env.commit, DownloadLocation: "NOASSERTION", LicenseDeclared: "NOASSERTION"}
+		if len(env.gitURL) > 0 {
+			envPkg.DownloadLocation = "git+" + env.gitURL
+			if len(env.commit) > 0 {
+				envPkg.DownloadLocation += "@" + env.commit
+			}
+		}
+		doc.Packages = append(doc.Packages, envPkg)
+		doc.Relationships = append(doc.Relationships, SPDXRelationship{SPDXElementID: "SPDXRef-DOCUMENT", RelationshipType: "DESCRIBES", RelatedSPDXElement: envID})
+		for _, m := range env.modules {
+			p := SPDXPackage{SPDXID: spdxID(env.name + "-" + m.kind + "-" + m.name), Name: m.name, VersionInfo: m.version, LicenseDeclared: spdxLicense(m.license), Description: m.description}
+			if m.kind == "forge" {
+				p.Supplier = "Organization: " + m.author
+				p.DownloadLocation = "NOASSERTION"
+				p.ExternalRefs = []SPDXExternalRef{{ReferenceCategory: "PACKAGE-MANAGER", ReferenceType: "purl", ReferenceLocator: forgePurl(m.author, m.name, m.version)}}
+				if len(m.sha256sum) > 0 {
+					p.Checksums = []SPDXChecksum{{Algorithm: "SHA256", ChecksumValue: m.sha256sum}}
+				}
+			} else {
+				p.DownloadLocation = "git+" + m.gitURL + "@" + m.version
+			}
+			doc.Packages = append(doc.Packages, p)
+			doc.Relationships = append(doc.Relationships, SPDXRelationship{SPDXElementID: envID, RelationshipType: "CONTAINS", RelatedSPDXElement: p.SPDXID})
+		}
+	}
+	return doc
+}
+
+// printSBOM prints the SBOM of all deployed Puppet environments in the given format
+func printSBOM(format string) {
+	var doc interface{}
+	switch format {
+	case "cyclonedx":
+		doc = buildCycloneDX(collectSBOMEnvironments())
+	case "spdx":
+		doc = buildSPDX(collectSBOMEnvironments())
+	default:
+		Fatalf("Error: unknown -sbom format " + format + " Valid formats are cyclonedx and spdx")
+	}
+	content, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		Fatalf("printSBOM(): Could not encode SBOM as JSON Error: " + err.Error())
+	}
+	fmt.Fprintln(os.Stdout, string(content))
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// tempPathPrefix is the prefix of all temporary download and extraction paths, which are renamed into place once they are complete
+const tempPathPrefix = ".g10k-tmp-"
+
+// workCtx gets cancelled when g10k receives SIGINT or SIGTERM to stop all outstanding git commands and HTTP requests
+var workCtx, cancelWork = context.WithCancel(context.Background())
+
+// tempPaths contains the temporary paths of the currently running downloads and extractions
+var tempPaths = struct {
+	sync.Mutex
+	m map[string]struct{}
+}{m: make(map[string]struct{})}
+
+// tempDirCounter makes the names of the temporary directories of this g10k run unique
+var tempDirCounter int64
+
+// handleSignals cancels all outstanding work on SIGINT and SIGTERM, removes the incomplete temporary paths and exits
+func handleSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		Warnf("WARN: Received signal " + sig.String() + ", cancelling outstanding work and removing incomplete downloads and extractions")
+		cancelWork()
+		removeTempPaths()
+		exitCode := 1
+		if s, ok := sig.(syscall.Signal); ok {
+			exitCode = 128 + int(s)
+		}
+		os.Exit(exitCode)
+	}()
+}
+
+// interrupted checks if g10k received SIGINT or SIGTERM and is shutting down
+func interrupted() bool {
+	return workCtx.Err() != nil
+}
+
+// createTempDir creates a temporary directory next to the given target path, which can be renamed into place atomically
+func createTempDir(target string) string {
+	parentDir := checkDirAndCreate(filepath.Dir(target), "parent dir of "+target)
+	var tempDir string
+	for {
+		// unlike ioutil.TempDir use the same permissions as checkDirAndCreate, because the directory gets renamed into place
+		tempDir = filepath.Join(parentDir, tempPathPrefix+filepath.Base(target)+"-"+strconv.Itoa(os.Getpid())+"-"+strconv.FormatInt(atomic.AddInt64(&tempDirCounter, 1), 10))
+		err := os.Mkdir(tempDir, 0777)
+		if err == nil {
+			break
+		} else if !os.IsExist(err) {
+			Fatalf("createTempDir(): Error while creating temporary directory in " + parentDir + " Error: " + err.Error())
+		}
+	}
+	tempPaths.Lock()
+	tempPaths.m[tempDir] = struct{}{}
+	tempPaths.Unlock()
+	return tempDir
+}
+
+// removeTempDir removes the given temporary directory including all remaining incomplete files
+func removeTempDir(tempDir string) {
+	tempPaths.Lock()
+	delete(tempPaths.m, tempDir)
+	tempPaths.Unlock()
+	if err := os.RemoveAll(tempDir); err != nil {
+		Warnf("WARN: Error while removing temporary directory " + tempDir + " Error: " + err.Error())
+	}
+}
+
+// removeTempPaths removes all temporary paths of unfinished downloads and extractions
+func removeTempPaths() {
+	tempPaths.Lock()
+	defer tempPaths.Unlock()
+	for tempPath := range tempPaths.m {
+		Debugf("Removing incomplete temporary path " + tempPath)
+		_ = os.RemoveAll(tempPath)
+		delete(tempPaths.m, tempPath)
+	}
+}
+
+// renameIntoPlace moves the completed source path to the target path, an existing target directory gets replaced
+func renameIntoPlace(source string, target string) {
+	if _, err := os.Lstat(target); err == nil {
+		Debugf("Removing " + target + " to replace it with " + source)
+		if err := os.RemoveAll(target); err != nil {
+			Fatalf("renameIntoPlace(): Error while removing " + target + " Error: " + err.Error())
+		}
+	}
+	if err := os.Rename(source, target); err != nil {
+		Fatalf("renameIntoPlace(): Error while renaming " + source + " to " + target + " Error: " + err.Error())
+	}
+}
+
+// writeFileAtomic writes the content to a temporary file next to the given file and renames it into place, so that the file is never partially written
+func writeFileAtomic(file string, content []byte, mode os.FileMode) error {
+	tmpFile, err := ioutil.TempFile(filepath.Dir(file), tempPathPrefix+filepath.Base(file)+"-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err = tmpFile.Write(content); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err = tmpFile.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(tmpFile.Name(), mode); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), file)
+}
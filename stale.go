@@ -57,6 +57,9 @@ func purgeUnmanagedContent(allBasedirs map[string]bool, allEnvironments map[stri
 							Debugf("Not purging environment " + env + " due to deployment_purge_allowlist match")
 						} else {
 							Infof("Removing unmanaged environment " + env)
+							if diffMode {
+								recordEnvironmentDiff(envName, "purge", "", "", nil)
+							}
 							if !dryRun {
 								purgeDir(env, "purgeStaleContent()")
 							}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// PuppetfileUpdate describes a version bump of a single module in the Puppetfile
+type PuppetfileUpdate struct {
+	name       string
+	kind       string
+	oldVersion string
+	newVersion string
+	sha256sum  string
+}
+
+var reUpdateModuleLine = regexp.MustCompile(`^\s*mod\s+['"]([^'"]+)['"]`)
+var reUpdateModuleNameSeparator = regexp.MustCompile(`[/-]`)
+var reUpdateSha256sum = regexp.MustCompile(`(:sha256sum\s*=>\s*['"])[0-9a-fA-F]*(['"])`)
+
+// allowedUpdateLevel checks if the update from version current to candidate is allowed with the given -updatelevel
+func allowedUpdateLevel(current string, candidate string, level string) bool {
+	cv, _ := parseSemver(current)
+	nv, ok := parseSemver(candidate)
+	if !ok {
+		return false
+	}
+	switch level {
+	case "minor":
+		return cv[0] == nv[0]
+	case "patch":
+		return cv[0] == nv[0] && cv[1] == nv[1]
+	}
+	return true
+}
+
+// newestAllowedVersion returns the newest version of the given versions that is newer than current and allowed by the given -updatelevel
+func newestAllowedVersion(current string, versions []string, level string) string {
+	newest := ""
+	for _, version := range newerSemverVersions(current, versions) {
+		if allowedUpdateLevel(current, version, level) {
+			newest = version
+		}
+	}
+	return newest
+}
+
+// updateModuleSelected checks the -updateinclude and -updateexclude lists for the given module names
+func updateModuleSelected(names ...string) bool {
+	matches := func(list string) bool {
+		for _, entry := range strings.Split(list, ",") {
+			entry = strings.TrimSpace(entry)
+			for _, name := range names {
+				if len(entry) > 0 && entry == name {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	if len(updateInclude) > 0 && !matches(updateInclude) {
+		return false
+	}
+	return !matches(updateExclude)
+}
+
+// collectPuppetfileUpdates returns the newer versions of all Forge modules with pinned versions and all git modules pinned to semver tags
+func collectPuppetfileUpdates(pf Puppetfile, level string) map[string]PuppetfileUpdate {
+	updates := make(map[string]PuppetfileUpdate)
+	for name, fm := range pf.forgeModules {
+		if _, ok := parseSemver(fm.version); !ok {
+			Debugf("Skipping Forge module " + fm.author + "/" + fm.name + " with version " + fm.version)
+			continue
+		}
+		if !updateModuleSelected(fm.name, fm.author+"/"+fm.name, fm.author+"-"+fm.name) {
+			continue
+		}
+		if len(fm.baseURL) == 0 {
+			fm.baseURL = pf.forgeBaseURL
+		}
+		newVersion := ""
+		if level == "major" {
+			if latest := queryForgeAPI(fm).versionNumber; len(newerSemverVersions(fm.version, []string{latest})) > 0 {
+				newVersion = latest
+			}
+		} else {
+			newVersion = newestAllowedVersion(fm.version, queryForgeReleases(fm), level)
+		}
+		if len(newVersion) == 0 {
+			continue
+		}
+		update := PuppetfileUpdate{name: fm.author + "/" + fm.name, kind: "forge", oldVersion: fm.version, newVersion: newVersion}
+		if len(fm.sha256sum) > 0 {
+			// a pinned sha256sum needs to match the new release
+			fm.version = newVersion
+			update.sha256sum = getMetadataForgeModule(fm).sha256sum
+		}
+		updates[name] = update
+	}
+	for name, gm := range pf.gitModules {
+		if _, ok := parseSemver(gm.tag); !ok {
+			continue
+		}
+		if !updateModuleSelected(name) {
+			continue
+		}
+		if gm.mirrorMode == "shallow" {
+			Warnf("WARN: Skipping git module " + name + " because its shallow mirror does not contain any tags")
+			continue
+		}
+		gitDir := gitModuleCacheDir(gm)
+		if !doMirrorOrUpdate(gm, gitDir, 0) && !isDir(gitDir) {
+			Warnf("WARN: Skipping git module " + name + " because its git repository " + gm.git + " could not be mirrored")
+			continue
+		}
+		if newVersion := newestAllowedVersion(gm.tag, gitMirrorTags(gitDir), level); len(newVersion) > 0 {
+			updates[name] = PuppetfileUpdate{name: name, kind: "git", oldVersion: gm.tag, newVersion: newVersion}
+		}
+	}
+	return updates
+}
+
+// rewritePuppetfile replaces the versions of the given module updates in the Puppetfile content and keeps all comments and formatting
+func rewritePuppetfile(content string, updates map[string]PuppetfileUpdate) string {
+	lines := strings.SplitAfter(content, "\n")
+	var current *PuppetfileUpdate
+	replaced := false
+	for i, line := range lines {
+		if m := reUpdateModuleLine.FindStringSubmatch(line); len(m) > 1 {
+			current = nil
+			replaced = false
+			moduleName := m[1]
+			if u, ok := updates[moduleName]; ok && u.kind == "git" {
+				current = &u
+			} else if comp := reUpdateModuleNameSeparator.Split(moduleName, 2); len(comp) == 2 {
+				if u, ok := updates[comp[1]]; ok && u.kind == "forge" {
+					current = &u
+				}
+			}
+		}
+		if current == nil || strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		if !replaced {
+			reVersion := regexp.MustCompile(`(['"])` + regexp.QuoteMeta(current.oldVersion) + `(['"])`)
+			if current.kind == "git" {
+				reVersion = regexp.MustCompile(`(:tag\s*=>\s*['"])` + regexp.QuoteMeta(current.oldVersion) + `(['"])`)
+			}
+			if loc := reVersion.FindStringSubmatchIndex(line); loc != nil {
+				lines[i] = line[:loc[3]] + current.newVersion + line[loc[4]:]
+				line = lines[i]
+				replaced = true
+			}
+		}
+		if len(current.sha256sum) > 0 {
+			lines[i] = reUpdateSha256sum.ReplaceAllString(line, "${1}"+current.sha256sum+"${2}")
+		}
+	}
+	return strings.Join(lines, "")
+}
+
+// updatePuppetfile bumps the pinned module versions of the given Puppetfile in place and prints a summary of the changes
+func updatePuppetfile(file string, pf Puppetfile, level string) {
+	if level != "major" && level != "minor" && level != "patch" {
+		Fatalf("Error: unknown -updatelevel " + level + " Valid levels are major, minor and patch")
+	}
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		Fatalf("updatePuppetfile(): Error while reading Puppetfile " + file + " Error: " + err.Error())
+	}
+	updates := collectPuppetfileUpdates(pf, level)
+	if len(updates) == 0 {
+		fmt.Println("All modules in " + file + " are up to date")
+		return
+	}
+	updated := rewritePuppetfile(string(content), updates)
+	if !dryRun {
+		fi, err := os.Stat(file)
+		if err != nil {
+			Fatalf("updatePuppetfile(): Error while accessing Puppetfile " + file + " Error: " + err.Error())
+		}
+		if err := ioutil.WriteFile(file, []byte(updated), fi.Mode()); err != nil {
+			Fatalf("updatePuppetfile(): Error while writing Puppetfile " + file + " Error: " + err.Error())
+		}
+	}
+
+	summary := []string{}
+	for _, u := range updates {
+		summary = append(summary, "- "+u.kind+" module "+u.name+": "+u.oldVersion+" -> "+u.newVersion)
+	}
+	sort.Strings(summary)
+	if dryRun {
+		fmt.Println("Would update " + file + ":")
+	} else {
+		fmt.Println("Updated " + file + ":")
+	}
+	fmt.Println(strings.Join(summary, "\n"))
+}